@@ -5,8 +5,18 @@ import "strconv"
 import "errors"
 import "unicode"
 import "strings"
+import "io"
+import "sort"
+import "sync"
+import "reflect"
+import "time"
+import "runtime"
+import "hash/fnv"
+import "math/bits"
+import "sync/atomic"
+import "unicode/utf8"
+import "regexp"
 
-//import "io"
 //import "os"
 //import "bytes"
 import "bufio"
@@ -20,6 +30,25 @@ const (
 	t_number_rat   = iota
 	t_head_symbol  = iota
 	t_function     = iota
+	t_error        = iota
+	t_primitive    = iota
+	t_task         = iota
+	t_channel      = iota
+	t_eof          = iota
+	t_atom         = iota
+	t_ref          = iota
+	t_timer        = iota
+	t_pid          = iota
+	t_promise      = iota
+	t_generator    = iota
+	t_hash         = iota
+	t_vector       = iota
+	t_pmap         = iota
+	t_pvec         = iota
+	t_record       = iota
+	t_object       = iota
+	t_char         = iota
+	t_regexp       = iota
 )
 
 var typenames = map[int]string{
@@ -30,6 +59,25 @@ var typenames = map[int]string{
 	t_number_rat:   "rational",
 	t_head_symbol:  "head-symbol",
 	t_function:     "function",
+	t_error:        "error",
+	t_primitive:    "primitive",
+	t_task:         "task",
+	t_channel:      "channel",
+	t_eof:          "eof",
+	t_atom:         "atom",
+	t_ref:          "ref",
+	t_timer:        "timer",
+	t_pid:          "pid",
+	t_promise:      "promise",
+	t_generator:    "generator",
+	t_hash:         "hash",
+	t_vector:       "vector",
+	t_pmap:         "persistent-map",
+	t_pvec:         "persistent-vector",
+	t_record:       "record",
+	t_object:       "object",
+	t_char:         "char",
+	t_regexp:       "regexp",
 }
 
 type rational struct {
@@ -54,6 +102,13 @@ eval(ast{(+ -> x -> y)} env{x: 2, y: 1}) => 3
 type function_value struct {
 	args   [][]rune
 	action *tree
+	/* the raw parameter list when it contains nested patterns like
+	(lambda ((x y) z) ...); nil when every parameter is a plain symbol */
+	patterns []value
+	/* the parameter list itself when it has . or _ at the top level, as in
+	(lambda (a . rest) ...); the arguments are destructured against it as
+	one list */
+	whole *value
 }
 
 type value struct {
@@ -63,6 +118,129 @@ type value struct {
 	ast         *tree
 	number      number_value
 	function    function_value
+	pos         srcpos
+	/* set on symbols made by gensym, which are only ever equal to themselves */
+	uninterned bool
+	/* the payload of the types that carry one, such as the *error_value
+	of a t_error; the methods below give it back typed */
+	obj interface{}
+}
+
+func (v value) err() *error_value {
+	e, _ := v.obj.(*error_value)
+	return e
+}
+
+func (v value) prim() *primitive {
+	p, _ := v.obj.(*primitive)
+	return p
+}
+
+func (v value) task() *task {
+	t, _ := v.obj.(*task)
+	return t
+}
+
+func (v value) channel() *channel {
+	c, _ := v.obj.(*channel)
+	return c
+}
+
+func (v value) atom() *atom {
+	a, _ := v.obj.(*atom)
+	return a
+}
+
+func (v value) ref() *ref {
+	r, _ := v.obj.(*ref)
+	return r
+}
+
+func (v value) timer() *timer {
+	t, _ := v.obj.(*timer)
+	return t
+}
+
+func (v value) actor() *actor {
+	a, _ := v.obj.(*actor)
+	return a
+}
+
+func (v value) promise() *promise {
+	p, _ := v.obj.(*promise)
+	return p
+}
+
+func (v value) generator() *generator {
+	g, _ := v.obj.(*generator)
+	return g
+}
+
+func (v value) hash() *hashtable {
+	h, _ := v.obj.(*hashtable)
+	return h
+}
+
+func (v value) vector() *vector {
+	vec, _ := v.obj.(*vector)
+	return vec
+}
+
+func (v value) pmap() *persistent_map {
+	p, _ := v.obj.(*persistent_map)
+	return p
+}
+
+func (v value) pvec() *persistent_vector {
+	vec, _ := v.obj.(*persistent_vector)
+	return vec
+}
+
+func (v value) record() *record {
+	r, _ := v.obj.(*record)
+	return r
+}
+
+func (v value) object() *object {
+	o, _ := v.obj.(*object)
+	return o
+}
+
+func (v value) rx() *regexp.Regexp {
+	rx, _ := v.obj.(*regexp.Regexp)
+	return rx
+}
+
+// where a value was read from. offset is only used while parsing; a zero
+// line means the value didn't come from source
+type srcpos struct {
+	file   string
+	line   int
+	col    int
+	offset int
+}
+
+func (p srcpos) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.file, p.line, p.col)
+}
+
+// an error object, made by (error ...) or by try catching a failure from
+// a builtin
+type error_value struct {
+	kind      []rune
+	message   string
+	irritants []value
+	/* filled in when the error is caught, from the radu_error that
+	carried it */
+	form  *tree
+	trace []frame
+}
+
+// a function implemented in Go rather than with lambda, such as a
+// continuation; it is called with its arguments already evaluated
+type primitive struct {
+	name string
+	fn   func(args []value, bindings *env) (value, error)
 }
 
 type tree struct {
@@ -71,11 +249,115 @@ type tree struct {
 	next     *tree
 	parent   *tree
 }
+
+// an env can be shared between goroutines (tasks, pmap workers, or a
+// program embedding radu that calls run_source from several places at
+// once), so its map is only touched under mu. Each read or write of one
+// variable is atomic. Between goroutines, a write is seen by a later read
+// once something orders the two: spawn comes before the task's first step,
+// a task's last step before its join returns, a send before the receive
+// that takes it, and every call pmap makes before pmap returns. Nothing
+// makes a read then a write atomic, so (set! n (+ n 1)) in two tasks can
+// lose an update.
 type env struct {
+	mu     sync.RWMutex
 	values map[string]value
 	prev   *env
 }
 
+func new_env(values map[string]value, prev *env) *env {
+	return &env{values: values, prev: prev}
+}
+
+func (e *env) get(name string) (value, bool) {
+	e.mu.RLock()
+	v, ok := e.values[name]
+	e.mu.RUnlock()
+	return v, ok
+}
+
+func (e *env) set(name string, v value) {
+	e.mu.Lock()
+	e.values[name] = v
+	e.mu.Unlock()
+}
+
+func (e *env) set_all(binds map[string]value) {
+	e.mu.Lock()
+	for k, v := range binds {
+		e.values[k] = v
+	}
+	e.mu.Unlock()
+}
+
+/* replace name in the nearest env that binds it; false if none does */
+func (e *env) update(name string, v value) bool {
+	for b := e; b != nil; b = b.prev {
+		b.mu.Lock()
+		if _, ok := b.values[name]; ok {
+			b.values[name] = v
+			b.mu.Unlock()
+			return true
+		}
+		b.mu.Unlock()
+	}
+	return false
+}
+
+// a frame of the radu stack: a call, by the name it was called with, and
+// where the call is in the source
+type frame struct {
+	name string
+	pos  srcpos
+}
+
+// radu_error is how a failure travels back up through eval2. obj is what
+// was raised: an error object, or any value given to raise. form is the
+// innermost form being evaluated when it happened, and trace gains a frame
+// for every call it unwinds through, innermost first.
+type radu_error struct {
+	obj   value
+	form  *tree
+	trace []frame
+	/* set once handlers have seen it, so it isn't signalled twice */
+	signalled bool
+}
+
+func (e *radu_error) Error() string {
+	if e.obj.valtype == t_error {
+		return error_text(e.obj.err())
+	}
+	return fmt.Sprintf("error: uncaught raise of %s", value_string(e.obj))
+}
+
+// report is the full description the repl prints: the message with its
+// position, the offending form, and the stack
+func (e *radu_error) report() string {
+	msg := e.Error()
+	if e.form != nil {
+		if e.form.val.pos.line > 0 {
+			msg = e.form.val.pos.String() + ": " + msg
+		}
+		msg += "\n    in " + pattern_string(e.form.val)
+	}
+	for _, f := range e.trace {
+		msg += fmt.Sprintf("\n  called from %s at %s", f.name, f.pos)
+	}
+	return msg
+}
+
+func new_error(kind string, format string, a ...interface{}) error {
+	return &radu_error{value_error_init([]rune(kind), fmt.Sprintf(format, a...), make([]value, 0)), nil, make([]frame, 0), false}
+}
+
+/* as_radu_error wraps a builtin's plain error as a runtime error */
+func as_radu_error(err error) *radu_error {
+	if re, ok := err.(*radu_error); ok {
+		return re
+	}
+	return &radu_error{value_error_init([]rune("runtime"), strings.TrimPrefix(err.Error(), "error: "), make([]value, 0)), nil, make([]frame, 0), false}
+}
+
 type convError struct {
 	from string
 	to   string
@@ -94,30 +376,116 @@ func show_value(valtype string, val string) string {
 }
 
 func value_symbol_init(name []rune) value {
-	return value{make([]rune, 0), t_symbol, name, nil, number_value{0, 0, rational{0, 0}}, function_value{make([][]rune, 0), nil}}
+	return value{valtype: t_symbol, symbol: name}
 }
 
 func value_head_symbol_init(name []rune) value {
-	return value{make([]rune, 0), t_head_symbol, name, nil, number_value{0, 0, rational{0, 0}}, function_value{make([][]rune, 0), nil}}
+	return value{valtype: t_head_symbol, symbol: name}
 }
 
 func value_ast_init(ast *tree) value {
-	return value{make([]rune, 0), t_tree, make([]rune, 0), ast, number_value{0, 0, rational{0, 0}}, function_value{make([][]rune, 0), nil}}
+	return value{valtype: t_tree, ast: ast}
 }
 
 func value_number_int_init(n int64) value {
-	return value{make([]rune, 0), t_number_int, make([]rune, 0), nil, number_value{0, n, rational{0, 0}}, function_value{make([][]rune, 0), nil}}
+	return value{valtype: t_number_int, number: number_value{intval: n}}
 }
 
 func value_number_float_init(n float64) value {
-	return value{make([]rune, 0), t_number_float, make([]rune, 0), nil, number_value{n, 0, rational{0, 0}}, function_value{make([][]rune, 0), nil}}
+	return value{valtype: t_number_float, number: number_value{floatval: n}}
+}
+
+func value_error_init(kind []rune, message string, irritants []value) value {
+	return value{valtype: t_error, obj: &error_value{kind: kind, message: message, irritants: irritants}}
+}
+
+func value_primitive_init(name string, fn func(args []value, bindings *env) (value, error)) value {
+	return value{valtype: t_primitive, obj: &primitive{name, fn}}
+}
+
+func value_task_init(t *task) value {
+	return value{valtype: t_task, obj: t}
+}
+
+func value_channel_init(c *channel) value {
+	return value{valtype: t_channel, obj: c}
+}
+
+func value_atom_init(a *atom) value {
+	return value{valtype: t_atom, obj: a}
+}
+
+func value_ref_init(r *ref) value {
+	return value{valtype: t_ref, obj: r}
+}
+
+func value_timer_init(t *timer) value {
+	return value{valtype: t_timer, obj: t}
+}
+
+func value_pid_init(a *actor) value {
+	return value{valtype: t_pid, obj: a}
+}
+
+func value_promise_init(p *promise) value {
+	return value{valtype: t_promise, obj: p}
+}
+
+func value_generator_init(g *generator) value {
+	return value{valtype: t_generator, obj: g}
+}
+
+func value_hash_init(h *hashtable) value {
+	return value{valtype: t_hash, obj: h}
 }
 
-func value_function_init(args [][]rune, action *tree) value {
-	return value{make([]rune, 0), t_function, make([]rune, 0), nil, number_value{0, 0, rational{0, 0}}, function_value{args, action}}
+func value_vector_init(v *vector) value {
+	return value{valtype: t_vector, obj: v}
 }
 
-func parse(input []rune, n int, ast *tree, dec []rune, in_str bool) int {
+func value_pmap_init(m *persistent_map) value {
+	return value{valtype: t_pmap, obj: m}
+}
+
+func value_pvec_init(v *persistent_vector) value {
+	return value{valtype: t_pvec, obj: v}
+}
+
+func value_record_init(r *record) value {
+	return value{valtype: t_record, obj: r}
+}
+
+func value_object_init(o *object) value {
+	return value{valtype: t_object, obj: o}
+}
+
+/* a character keeps its rune as its one-rune symbol */
+func value_char_init(r rune) value {
+	v := value_symbol_init([]rune{r})
+	v.valtype = t_char
+	return v
+}
+
+func value_regexp_init(rx *regexp.Regexp) value {
+	return value{valtype: t_regexp, obj: rx}
+}
+
+/* what receive gives back from a closed channel */
+func eof_value() value {
+	return value{valtype: t_eof}
+}
+
+func value_function_init(args [][]rune, action *tree, patterns []value) value {
+	return value{valtype: t_function, function: function_value{args: args, action: action, patterns: patterns}}
+}
+
+// reader_prefix says whether sym, written right before a (, marks a
+// literal like #(1 2 3) or #hash((k v) ...) rather than a mistake
+func reader_prefix(sym []rune) bool {
+	return string(sym) == "#hash" || string(sym) == "#"
+}
+
+func parse(input []rune, n int, ast *tree, dec []rune, in_str bool) error {
 	if n == len(input) {
 		//fmt.Printf("done")
 	} else {
@@ -129,21 +497,26 @@ func parse(input []rune, n int, ast *tree, dec []rune, in_str bool) int {
 					// now collect arguments
 					//tree { value { make([]rune, 0), nil }, false, nil};
 					// just move on because we do the tree allocation and nexting with ' '
-					parse(input, n+1, ast, dec, false)
+					return parse(input, n+1, ast, dec, false)
 				} else {
-					if len(ast.val.symbol) == 0 {
+					if len(ast.val.symbol) == 0 || reader_prefix(ast.val.symbol) {
 						// case like ((... so parse
-						ast.val.decorations = dec
+						if ast.val.pos.offset == 0 {
+							ast.val.pos.offset = n + 1
+						}
+						/* a prefix like #hash is kept with the decorations */
+						ast.val.decorations = append(append(make([]rune, 0), dec...), ast.val.symbol...)
+						ast.val.symbol = make([]rune, 0)
 						ast.val.valtype = t_tree
 						ast.val.ast = &tree{value_symbol_init(make([]rune, 0)), false, nil, ast}
-						parse(input, n+1, ast.val.ast, make([]rune, 0), false)
+						return parse(input, n+1, ast.val.ast, make([]rune, 0), false)
 					} else {
 						fmt.Printf("error: unexpected ( in tree value\n")
 					}
 				}
 			} else {
 				ast.val.symbol = append(ast.val.symbol, input[n])
-				parse(input, n+1, ast, dec, true)
+				return parse(input, n+1, ast, dec, true)
 			}
 			break
 		case ')':
@@ -154,71 +527,194 @@ func parse(input []rune, n int, ast *tree, dec []rune, in_str bool) int {
 				}
 			} else {
 				ast.val.symbol = append(ast.val.symbol, input[n])
-				parse(input, n+1, ast, dec, true)
+				return parse(input, n+1, ast, dec, true)
 			}
 			break
-		case ' ', '\n':
+		case ' ', '\n', '\t', '\r':
 			if !in_str {
 				fmt.Println("not in string")
+				g := n
+				for g < len(input) && unicode.IsSpace(input[g]) {
+					g++
+				}
+				if ast.val.valtype != t_tree && len(ast.val.symbol) == 0 && len(ast.val.decorations) == 0 {
+					// nothing collected yet, so this is leading whitespace
+					return parse(input, g, ast, dec, false)
+				}
 				if !ast.done_val {
 					ast.done_val = true
 				}
-				if n+1 != len(input) {
-					// finish off the last item
-					ast.next = &tree{value_symbol_init(make([]rune, 0)), false, nil, ast.parent}
-					if input[n+1] != ' ' {
-						// get next argument
-						parse(input, n+1, ast.next, make([]rune, 0), false)
+				if g != len(input) {
+					if input[g] == ')' {
+						// whitespace before a ) doesn't start another item
+						return parse(input, g, ast, dec, false)
 					} else {
-						for g := n; g < len(input); g++ {
-							if input[g] != ' ' {
-								parse(input, g, ast.next, make([]rune, 0), false)
-								break
-							}
-						}
+						// finish off the last item and get the next argument
+						ast.next = &tree{value_symbol_init(make([]rune, 0)), false, nil, ast.parent}
+						return parse(input, g, ast.next, make([]rune, 0), false)
 					}
 				}
 			} else {
 				fmt.Println("appending to ", ast.val.symbol)
 				ast.val.symbol = append(ast.val.symbol, input[n])
-				parse(input, n+1, ast, dec, true)
+				return parse(input, n+1, ast, dec, true)
 			}
 			break
 		default:
+			if ast.val.pos.offset == 0 {
+				ast.val.pos.offset = n + 1
+			}
 			if len(ast.val.symbol) == 0 && (input[n] == ',' || input[n] == '\'' || input[n] == '`' || input[n] == '@') {
 				ast.val.decorations = append(ast.val.decorations, input[n])
-				parse(input, n+1, ast, append(dec, input[n]), false) // set the next thing to be escaped, whatever it is
+				return parse(input, n+1, ast, append(dec, input[n]), false) // set the next thing to be escaped, whatever it is
+			} else if len(ast.val.symbol) == 0 && input[n] == '#' && n+2 < len(input) && input[n+1] == '\\' {
+				/* #\( and #\space: the rune after the \ is always part of it */
+				ast.val.symbol = append(ast.val.symbol, input[n:n+3]...)
+				return parse(input, n+3, ast, dec, false)
+			} else if len(ast.val.symbol) == 0 && input[n] == '|' {
+				/* |a symbol with spaces| takes everything up to the next | */
+				end := n + 1
+				for end < len(input) && input[end] != '|' {
+					end++
+				}
+				if end == len(input) {
+					ast.val.symbol = input[n:]
+					re := new_error("parse-error", "unterminated | in symbol").(*radu_error)
+					re.form = ast
+					return re
+				}
+				ast.val.symbol = []rune(symbol_name(string(input[n+1 : end])))
+				return parse(input, min(end+1, len(input)), ast, dec, false)
 			} else {
 				ast.val.symbol = append(ast.val.symbol, input[n])
-				if len(ast.val.symbol) == 0 && input[n] == '"' {
-					in_str = true
-				}
-				if len(ast.val.symbol) > 0 && input[n] == '"' {
-					in_str = false
+				if input[n] == '"' {
+					// an opening quote is the first rune of the symbol,
+					// or comes straight after #rx
+					in_str = len(ast.val.symbol) == 1 || string(ast.val.symbol) == "#rx\""
 				}
-				parse(input, n+1, ast, dec, in_str)
+				return parse(input, n+1, ast, dec, in_str)
 			}
 		}
 	}
-	return 0
+	return nil
+}
+
+/* locate turns the offsets parse recorded into lines and columns */
+func locate(ast *tree, starts []int, file string) {
+	for ; ast != nil; ast = ast.next {
+		if ast.val.pos.offset > 0 {
+			off := ast.val.pos.offset - 1
+			line := sort.Search(len(starts), func(i int) bool { return starts[i] > off })
+			ast.val.pos = srcpos{file, line, off - starts[line-1] + 1, 0}
+		}
+		if ast.val.valtype == t_tree {
+			locate(ast.val.ast, starts, file)
+		}
+	}
+}
+
+// every symbol read from source shares the rune slice kept here for its
+// name, so that two mentions of the same symbol compare by pointer
+var symbols sync.Map
+
+func intern(name []rune) []rune {
+	if v, ok := symbols.Load(string(name)); ok {
+		return v.([]rune)
+	}
+	/* no spare capacity, so nobody can append over a shared name */
+	v, _ := symbols.LoadOrStore(string(name), name[:len(name):len(name)])
+	return v.([]rune)
+}
+
+func intern_tree(ast *tree) {
+	for ; ast != nil; ast = ast.next {
+		v := &ast.val
+		switch {
+		case v.valtype == t_tree:
+			intern_tree(v.ast)
+		case is_symbol(*v) && len(v.symbol) > 0 && !symisstring(v.symbol) && !is_integer(v.symbol) && !is_float(v.symbol):
+			v.symbol = intern(v.symbol)
+		}
+	}
+}
+
+// symbol_name is how a symbol called name is written: as it is, or
+// between bars when it couldn't be read back otherwise
+func symbol_name(name string) string {
+	if name == "" || is_integer([]rune(name)) || is_float([]rune(name)) || strings.ContainsAny(name, " \t\r\n()\"'`,@|;") {
+		return "|" + name + "|"
+	}
+	return name
+}
+
+// same_symbol says whether two symbols are the same: interned ones share
+// their runes, so usually a pointer comparison is enough
+func same_symbol(a value, b value) bool {
+	if len(a.symbol) != len(b.symbol) {
+		return false
+	}
+	if len(a.symbol) == 0 || &a.symbol[0] == &b.symbol[0] {
+		return true
+	}
+	if a.uninterned || b.uninterned {
+		return false
+	}
+	return string(a.symbol) == string(b.symbol)
+}
+
+// read_program parses src, which came from file starting at first_line,
+// into a tree ready for prognfunc. Source it can't read comes back as a
+// parse-error.
+func read_program(src []rune, file string, first_line int) (*tree, error) {
+	program := tree{value_symbol_init(make([]rune, 0)), false, nil, nil}
+	err := parse(src, 0, &program, make([]rune, 0), false)
+	// every line before first_line starts at 0, so src's first line
+	// comes out numbered first_line
+	starts := make([]int, first_line)
+	for i, r := range src {
+		if r == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	locate(&program, starts, file)
+	if err != nil {
+		return nil, err
+	}
+	intern_tree(&program)
+	return &program, nil
+}
+
+// run_source is the way in for anything embedding radu: it evaluates
+// every form in src and returns the last value. Failures come back as a
+// *radu_error, which knows the offending form and the radu stack.
+func run_source(src string, file string, bindings *env) (value, error) {
+	program, err := read_program([]rune(src), file, 1)
+	if err != nil {
+		return blank_value(), err
+	}
+	return prognfunc(program, bindings)
 }
 
 func print_tree(ast *tree) {
+	fprint_tree(os.Stdout, ast)
+}
+
+func fprint_tree(w io.Writer, ast *tree) {
 	if ast != nil {
 		if ast.val.ast == nil {
-			print_value(ast.val)
+			fprint_value(w, ast.val)
 		} else {
-			fmt.Printf("(")
-			print_tree(ast.val.ast)
-			fmt.Printf(")")
+			fmt.Fprintf(w, "(")
+			fprint_tree(w, ast.val.ast)
+			fmt.Fprintf(w, ")")
 		}
 		//fmt.Printf("[%s]", typenames[ast.val.valtype])
 		if ast.next != nil {
-			fmt.Printf(" -> ")
-			print_tree(ast.next)
+			fmt.Fprintf(w, " -> ")
+			fprint_tree(w, ast.next)
 		}
 	} else {
-		fmt.Printf("()")
+		fmt.Fprintf(w, "()")
 	}
 }
 
@@ -229,28 +725,82 @@ func print_tree(ast *tree) {
 */
 
 func blank_value() value {
-	return value{make([]rune, 0), t_symbol, make([]rune, 0), nil, number_value{0, 0, rational{0, 0}}, function_value{make([][]rune, 0), nil}}
+	return value{valtype: t_symbol}
 }
 
 func quotefunc(ast *tree, bindings *env) (value, error) {
 	if ast.next != nil {
-		if ast.next.val.valtype != t_tree {
-			return value_ast_init(&tree{ast.next.val, false, nil, nil}), nil
-		} else {
-			return ast.next.val, nil
-		}
+		return quote_value(ast.next.val), nil
 	}
 	return blank_value(), errors.New("usage: (quote <value>)")
 }
 
-func listeval(ast *tree, bindings *env, original *tree) (*tree, error) {
+// quote_value turns source into data: symbols that look like numbers
+// become numbers and trees become lists in the same shape (list ...) makes,
+// so '(1 (2 3)) and (list 1 (list 2 3)) are the same thing
+func quote_value(v value) value {
+	switch v.valtype {
+	case t_tree:
+		/* #(...) and #hash(...) inside a quoted list are still literals */
+		switch string(v.decorations) {
+		case "#":
+			return vector_literal(v)
+		case "#hash":
+			if h, e := hash_literal(v); e == nil {
+				return h
+			}
+		}
+		return list_from_values(quote_members(v))
+	case t_symbol, t_head_symbol:
+		if len(v.decorations) == 0 && is_integer(v.symbol) {
+			if n, e := conv_integer(v.symbol); e == nil {
+				return value_number_int_init(n)
+			}
+		}
+		if len(v.decorations) == 0 && is_float(v.symbol) {
+			if n, e := conv_float(v.symbol); e == nil {
+				return value_number_float_init(n)
+			}
+		}
+		if len(v.decorations) == 0 && is_char_literal(v.symbol) {
+			if c, e := char_literal(v.symbol); e == nil {
+				return c
+			}
+		}
+		if len(v.decorations) == 0 && is_regexp_literal(v.symbol) {
+			if rx, e := regexp_literal(v.symbol); e == nil {
+				return rx
+			}
+		}
+	}
+	return v
+}
+
+// quote_members quotes each member of the tree v
+func quote_members(v value) []value {
+	vals := make([]value, 0)
+	for m := v.ast; m != nil; m = m.next {
+		if m == v.ast && m.next == nil && is_symbol(m.val) && len(m.val.symbol) == 0 {
+			// ()
+			break
+		}
+		vals = append(vals, quote_value(m.val))
+	}
+	return vals
+}
+
+// evaluate each member into a fresh node rather than over the top of the
+// source tree, so the same (list ...) form can be evaluated more than once
+// (e.g. in a loop body or a lambda called twice)
+func listeval(ast *tree, bindings *env, target *tree, original *tree) (*tree, error) {
 	var err error
-	ast.val, err = eval2(ast, bindings)
+	target.val, err = eval2(ast, bindings)
 	if err != nil {
 		return nil, err
 	}
 	if ast.next != nil {
-		return listeval(ast.next, bindings, original)
+		target.next = &tree{blank_value(), true, nil, nil}
+		return listeval(ast.next, bindings, target.next, original)
 	}
 	//fmt.Println("original: ")
 	return original, nil
@@ -262,7 +812,8 @@ func listfunc(ast *tree, bindings *env, ret *tree) (*tree, error) {
 		//return nil, errors.New("usage: (list x[ y z]); members will be evaluated.")
 		return &tree{value_ast_init(nil), true, nil, nil}, nil
 	}
-	if r, err := listeval(ast.next, bindings, ast.next); err == nil {
+	first := &tree{blank_value(), true, nil, nil}
+	if r, err := listeval(ast.next, bindings, first, first); err == nil {
 		//print_value(value{t_tree, make([]rune, 0), r, number_value{0, 0}, function_value{make([][]rune, 0), nil}})
 
 		return &tree{value_ast_init(r), true, nil, nil}, nil
@@ -305,11 +856,31 @@ func lambdafunc(ast *tree, bindings *env) (value, error) {
 	if ast.next.val.valtype != t_tree && ast.next.val.ast.val.valtype != t_symbol {
 		return blank_value(), errors.New(fmt.Sprintf("error: lambda arglist must be type_tree, given: %s", typenames[ast.next.val.valtype]))
 	}
+	params := tree_values(ast.next.val.ast)
+	if len(params) == 1 && is_symbol(params[0]) && len(params[0].symbol) == 0 {
+		// (lambda () ...)
+		return value_function_init(make([][]rune, 0), ast.next.next, nil), nil
+	}
+	var patterns []value
+	var whole *value
+	for _, p := range params {
+		if p.valtype == t_tree {
+			patterns = params
+		}
+		if sym_is(p, ".") || sym_is(p, "_") {
+			whole = &ast.next.val
+		}
+	}
 	if arglist, err := lambda_arglist(ast.next.val.ast, make([][]rune, 0), bindings); err == nil {
 		/*for _, r := range arglist {
 			fmt.Println("ss ", string(r))
 		}*/
-		return value_function_init(arglist, ast.next.next), nil
+		fn := value_function_init(arglist, ast.next.next, patterns)
+		if whole != nil && key_params(fn) >= 0 {
+			return blank_value(), errors.New("error: a lambda with &key can't also have . or _ in its parameters")
+		}
+		fn.function.whole = whole
+		return fn, nil
 	} else {
 		return blank_value(), err
 	}
@@ -373,7 +944,7 @@ func bound(symbol []rune, bindings *env) (value, error) {
 		print_value(u)
 		fmt.Println()
 	}*/
-	if val, ok := bindings.values[string(symbol)]; ok {
+	if val, ok := bindings.get(string(symbol)); ok {
 		return val, nil
 	}
 	if bindings.prev != nil {
@@ -381,7 +952,7 @@ func bound(symbol []rune, bindings *env) (value, error) {
 		return bound(symbol, bindings.prev)
 	} else {
 		return blank_value(),
-			errors.New(fmt.Sprintf("error: symbol %s not found in environment.", string(symbol)))
+			new_error("unbound-variable", "symbol %s not found in environment.", string(symbol))
 	}
 }
 
@@ -395,7 +966,7 @@ func collect_number_values(ast *tree,
 		if g.valtype == t_number_int || g.valtype == t_number_float || g.valtype == t_number_rat {
 			return collect_number_values(ast.next, bindings, append(vlist, g))
 		} else {
-			return make([]value, 0), errors.New(fmt.Sprintf("error: expected number, got %s", typenames[g.valtype]))
+			return make([]value, 0), new_error("type-error", "expected number, got %s", typenames[g.valtype])
 		}
 	} else {
 		return make([]value, 0), err
@@ -563,13 +1134,16 @@ func succfunc(ast *tree, bindings *env) (value, error) {
 		if item.valtype == t_number_int {
 			return value_number_int_init(item.number.intval + 1), nil
 		}
-		return blank_value(), errors.New(fmt.Sprintf("wrong type %s to succ; number_int expected.", typenames[item.valtype]))
+		return blank_value(), new_error("type-error", "wrong type %s to succ; int expected", typenames[item.valtype])
 	} else {
 		return blank_value(), err
 	}
 }
 
 func get_subjects(subject *tree, results []value, bindings *env) ([]value, error) {
+	if subject == nil {
+		return results, nil
+	}
 	if g, err := eval2(subject, bindings); err == nil {
 		results = append(results, g)
 	} else {
@@ -581,15 +1155,103 @@ func get_subjects(subject *tree, results []value, bindings *env) ([]value, error
 	return results, nil
 }
 
+// key_params gives where &key comes in fn's parameters, or -1. The
+// parameters after it are named, each name or (name default), and callers
+// pass them as :name value after the positional arguments
+func key_params(fn value) int {
+	for i, a := range fn.function.args {
+		if string(a) == "&key" {
+			return i
+		}
+	}
+	return -1
+}
+
+func bind_keys(fn value, args []value, bindings *env) error {
+	k := key_params(fn)
+	if len(args) < k || (len(args)-k)%2 != 0 {
+		return errors.New(fmt.Sprintf("error: lambda takes %d arguments followed by :name value pairs, given %d arguments", k, len(args)))
+	}
+	names := make([]string, 0)
+	defaults := make(map[string]*tree)
+	for i := k + 1; i < len(fn.function.args); i++ {
+		name := string(fn.function.args[i])
+		if fn.function.patterns != nil && fn.function.patterns[i].valtype == t_tree {
+			nd := fn.function.patterns[i].ast
+			if nd == nil || !is_symbol(nd.val) || nd.next == nil || nd.next.next != nil {
+				return errors.New("error: a &key parameter must be name or (name default)")
+			}
+			name = string(nd.val.symbol)
+			defaults[name] = nd.next
+		}
+		names = append(names, name)
+	}
+	binds := make(map[string]value)
+	for i := 0; i < k; i++ {
+		if fn.function.patterns != nil && fn.function.patterns[i].valtype == t_tree {
+			if e := destructure(fn.function.patterns[i], args[i], fn.function.patterns[i], binds); e != nil {
+				return e
+			}
+			continue
+		}
+		binds[string(fn.function.args[i])] = args[i]
+	}
+	given := make(map[string]value)
+	for i := k; i < len(args); i += 2 {
+		if !is_keyword(args[i]) {
+			return new_error("type-error", "expected a keyword naming an argument, given %s", value_string(args[i]))
+		}
+		given[string(args[i].symbol[1:])] = args[i+1]
+	}
+	for _, name := range names {
+		if v, ok := given[name]; ok {
+			binds[name] = v
+			delete(given, name)
+		} else if d, ok := defaults[name]; ok {
+			/* defaults can see the arguments before them */
+			v, e := eval2(d, new_env(binds, bindings))
+			if e != nil {
+				return e
+			}
+			binds[name] = v
+		} else {
+			binds[name] = falsesym()
+		}
+	}
+	for name := range given {
+		return new_error("type-error", "unknown keyword argument :%s", name)
+	}
+	bindings.set_all(binds)
+	return nil
+}
+
 func performfunc(v value, bindings *env, subject *tree) (value, error) {
 	//print_value(v)
 
 	/* set the bindings inside our lambda to be the same as the outside ones
 	but overwrite the ones named in the varlist */
 	//local_bindings := bindings.values
-	if g, err := get_subjects(subject, make([]value, 0), bindings); err == nil && len(g) == len(v.function.args) {
+	if g, err := get_subjects(subject, make([]value, 0), bindings); err == nil && key_params(v) >= 0 {
+		if e1 := bind_keys(v, g, bindings); e1 != nil {
+			return blank_value(), e1
+		}
+	} else if err == nil && v.function.whole != nil {
+		binds := make(map[string]value)
+		if e2 := destructure(*v.function.whole, list_from_values(g), *v.function.whole, binds); e2 != nil {
+			return blank_value(), e2
+		}
+		bindings.set_all(binds)
+	} else if err == nil && len(g) == len(v.function.args) {
 		for i, e := range v.function.args {
-			bindings.values[string(e)] = g[i]
+			if v.function.patterns != nil && v.function.patterns[i].valtype == t_tree {
+				binds := make(map[string]value)
+				if e2 := destructure(v.function.patterns[i], g[i], v.function.patterns[i], binds); e2 != nil {
+					return blank_value(), e2
+				}
+				bindings.set_all(binds)
+				continue
+			}
+			bindings.set(string(e), g[i])
 		}
 	} else {
 		if err != nil {
@@ -601,6 +1263,14 @@ func performfunc(v value, bindings *env, subject *tree) (value, error) {
 	return eval2(v.function.action, bindings)
 }
 
+func performprim(v value, bindings *env, subject *tree) (value, error) {
+	g, err := get_subjects(subject, make([]value, 0), bindings)
+	if err != nil {
+		return blank_value(), err
+	}
+	return v.prim().fn(g, bindings)
+}
+
 /*func eval(ast *tree, bindings *env) (value, error) {
 	return blank_value(), nil
 }*/
@@ -622,6 +1292,9 @@ func evalfunc(ast *tree, bindings *env) (value, error) {
 		if g.valtype == t_tree {
 			return eval2(g.ast, bindings)
 		}
+		if g.valtype == t_symbol {
+			return eval2(&tree{g, true, nil, nil}, bindings)
+		}
 		return g, nil
 	} else {
 		return blank_value(), err
@@ -695,6 +1368,25 @@ func let_binds(b *tree, names [][]rune, values []value, bindings *env) ([][]rune
 	if b.val.valtype == t_tree {
 		//print_tree(b.val.ast)
 		//print_value(b.ast)
+		if b.val.ast.val.valtype == t_tree {
+			/* ((a b) (list 1 2)) */
+			if b.val.ast.next == nil {
+				return nil, nil, errors.New(fmt.Sprintf("error: let binding must have value component; pattern: %s", pattern_string(b.val.ast.val)))
+			}
+			r, e := eval2(b.val.ast.next, bindings)
+			if e != nil {
+				return nil, nil, e
+			}
+			binds := make(map[string]value)
+			if e2 := destructure(b.val.ast.val, r, b.val.ast.val, binds); e2 != nil {
+				return nil, nil, e2
+			}
+			for k, v := range binds {
+				names = append(names, []rune(k))
+				values = append(values, v)
+			}
+			return let_binds(b.next, names, values, bindings)
+		}
 		if b.val.ast.val.valtype == t_symbol || b.val.ast.val.valtype == t_head_symbol {
 			if b.val.ast.next != nil {
 				if r, e := eval2(b.val.ast.next, bindings); e == nil {
@@ -703,7 +1395,7 @@ func let_binds(b *tree, names [][]rune, values []value, bindings *env) ([][]rune
 					return nil, nil, e
 				}
 			} else {
-				return nil, nil, errors.New(fmt.Sprintf("error: let binding must have value component; symbol: %s", b.val.ast.val.symbol))
+				return nil, nil, errors.New(fmt.Sprintf("error: let binding must have value component; symbol: %s", string(b.val.ast.val.symbol)))
 			}
 		} else {
 			return nil, nil, errors.New(fmt.Sprintf("error: let binding must bind to symbol, given type: %s", typenames[b.val.ast.val.valtype]))
@@ -714,11 +1406,85 @@ func let_binds(b *tree, names [][]rune, values []value, bindings *env) ([][]rune
 	}
 }
 
+// pattern_string shows a pattern from the source the way the list it
+// describes would print
+func pattern_string(pat value) string {
+	return value_string(quote_value(pat))
+}
+
+// destructure binds the symbols in the unevaluated pattern pat to the
+// matching parts of v. whole is the outermost pattern, kept so errors can
+// show where in it the mismatch happened.
+func destructure(pat value, v value, whole value, binds map[string]value) error {
+	if is_symbol(pat) {
+		if len(pat.symbol) == 0 || len(pat.decorations) > 0 || is_integer(pat.symbol) || is_float(pat.symbol) || symisstring(pat.symbol) {
+			return errors.New(fmt.Sprintf("error: pattern %s must contain symbols only, given %s", pattern_string(whole), pattern_string(pat)))
+		}
+		if string(pat.symbol) != "_" {
+			binds[string(pat.symbol)] = v
+		}
+		return nil
+	}
+	if pat.valtype != t_tree {
+		return errors.New(fmt.Sprintf("error: pattern %s must contain symbols only, given %s", pattern_string(whole), typenames[pat.valtype]))
+	}
+	vals, e := list_values(v)
+	if e != nil {
+		return errors.New(fmt.Sprintf("error: can't destructure %s with %s in pattern %s; expected list", value_string(v), pattern_string(pat), pattern_string(whole)))
+	}
+	pats := tree_values(pat.ast)
+	if len(pats) == 1 && is_symbol(pats[0]) && len(pats[0].symbol) == 0 {
+		pats = pats[:0]
+	}
+	for i, p := range pats {
+		if sym_is(p, ".") {
+			if i != len(pats)-2 {
+				return errors.New(fmt.Sprintf("error: . in pattern %s must be followed by exactly one symbol", pattern_string(whole)))
+			}
+			if len(vals) < i {
+				return errors.New(fmt.Sprintf("error: can't destructure %s with %s in pattern %s; expected at least %d values, got %d", value_string(v), pattern_string(pat), pattern_string(whole), i, len(vals)))
+			}
+			for j := 0; j < i; j++ {
+				if e1 := destructure(pats[j], vals[j], whole, binds); e1 != nil {
+					return e1
+				}
+			}
+			return destructure(pats[i+1], list_from_values(vals[i:]), whole, binds)
+		}
+	}
+	if len(pats) != len(vals) {
+		return errors.New(fmt.Sprintf("error: can't destructure %s with %s in pattern %s; expected %d values, got %d", value_string(v), pattern_string(pat), pattern_string(whole), len(pats), len(vals)))
+	}
+	for i, p := range pats {
+		if e1 := destructure(p, vals[i], whole, binds); e1 != nil {
+			return e1
+		}
+	}
+	return nil
+}
+
+func destructuringbindfunc(ast *tree, bindings *env) (value, error) {
+	/* (destructuring-bind (a (b c)) (list 1 (list 2 3)) body ...) */
+	if ast.next == nil || ast.next.next == nil || ast.next.next.next == nil {
+		return blank_value(), errors.New("usage: (destructuring-bind pattern value body[ body ...])")
+	}
+	v, e := eval2(ast.next.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	binds := make(map[string]value)
+	if e1 := destructure(ast.next.val, v, ast.next.val, binds); e1 != nil {
+		return blank_value(), e1
+	}
+	local := new_env(binds, bindings)
+	return prognfunc(ast.next.next.next, local)
+}
+
 func bind_let(kvs *tree, bindings *env) (*env, error) {
 	names, values, err := let_binds(kvs.val.ast, nil, nil, bindings)
 	if err == nil {
 		for i, v := range names {
-			bindings.values[string(v)] = values[i]
+			bindings.set(string(v), values[i])
 		}
 		return bindings, nil
 	} else {
@@ -757,11 +1523,10 @@ func prognfunc(ast *tree, bindings *env) (value, error) {
 	}
 	if ast.next != nil {
 		//fmt.Println("there is next")
-		prognfunc(ast.next, bindings)
+		return prognfunc(ast.next, bindings)
 	} else {
 		return r, nil
 	}
-	return blank_value(), nil
 }
 
 func truesym() value {
@@ -824,14 +1589,19 @@ func equalvals(v1 value, v2 value, bindings *env) (bool, error) {
 				return true, nil
 			}
 		case t_symbol, t_head_symbol:
-			for i, r := range v1.symbol {
-				if r != v2.symbol[i] {
-					return false, nil
-				}
-			}
-			return true, nil
+			return same_symbol(v1, v2), nil
 		case t_tree:
 			return equaltrees(v1.ast, v2.ast, bindings)
+		case t_function:
+			return v1.function.action == v2.function.action, nil
+		case t_primitive, t_error, t_hash, t_atom, t_ref, t_channel, t_task, t_timer, t_pid,
+			t_promise, t_generator, t_object:
+			/* these are only ever equal to themselves */
+			return v1.obj == v2.obj, nil
+		case t_char:
+			return v1.symbol[0] == v2.symbol[0], nil
+		case t_regexp:
+			return v1.rx().String() == v2.rx().String(), nil
 		}
 	} else {
 		return false, errors.New(fmt.Sprintf("error: different types do not equal; given: %s, %s", typenames[v1.valtype], typenames[v2.valtype]))
@@ -900,7 +1670,7 @@ func modfunc(ast *tree, bindings *env) (value, error) {
 			if n2, e2 := eval2(ast.next.next, bindings); e2 == nil {
 				if n2.valtype == t_number_int {
 					if n2.number.intval == 0 {
-						return blank_value(), errors.New("error: second argument to % cannot be 0")
+						return blank_value(), new_error("division-by-zero", "second argument to %% cannot be 0")
 					}
 					return value_number_int_init(n1.number.intval % n2.number.intval), nil
 				} else {
@@ -968,8 +1738,14 @@ func lenfunc(ast *tree, bindings *env) (value, error) {
 	if v, e := eval2(ast.next, bindings); e == nil {
 		if v.valtype == t_tree {
 			return value_number_int_init(listdepth(v.ast.val.ast, 1)), nil
+		} else if v.valtype == t_vector {
+			return value_number_int_init(int64(v.vector().length())), nil
+		} else if v.valtype == t_pvec {
+			return value_number_int_init(int64(v.pvec().count)), nil
+		} else if v.valtype == t_pmap {
+			return value_number_int_init(int64(v.pmap().count)), nil
 		} else {
-			return blank_value(), errors.New("error: lenfunc must be called on a list")
+			return blank_value(), errors.New("error: len must be called on a list")
 		}
 	} else {
 		return blank_value(), e
@@ -1023,7 +1799,7 @@ func prependfunc(ast *tree, bindings *env) (value, error) {
 			if v.valtype == t_tree {
 				return value_ast_init(&tree{value_ast_init(&tree{av, true, v.ast.val.ast, nil}), true, nil, nil}), nil
 			} else {
-				return blank_value(), errors.New("error: second argument to append must be list")
+				return blank_value(), errors.New("error: second argument to prepend must be list")
 			}
 		} else {
 			return blank_value(), e
@@ -1034,7 +1810,7 @@ func prependfunc(ast *tree, bindings *env) (value, error) {
 }
 
 func symisstring(sym []rune) bool {
-	if sym[0] == '"' && sym[len(sym)-1] == '"' {
+	if len(sym) >= 2 && sym[0] == '"' && sym[len(sym)-1] == '"' {
 		return true
 	}
 	return false
@@ -1044,6 +1820,16 @@ func stringify(sym []rune) []rune {
 	return sym[1 : len(sym)-1]
 }
 
+// string_value makes a string value, which like a string in the source is
+// a symbol wrapped in double quotes
+func string_value(s string) value {
+	return value_symbol_init([]rune("\"" + s + "\""))
+}
+
+func is_string(v value) bool {
+	return is_symbol(v) && symisstring(v.symbol)
+}
+
 func strindexfunc(ast *tree, bindings *env) (value, error) {
 	if ast.next == nil {
 		return blank_value(), errors.New("usage: (strindex \"my string\" n)")
@@ -1056,9 +1842,7 @@ func strindexfunc(ast *tree, bindings *env) (value, error) {
 						if posv.number.intval < 0 || posv.number.intval > int64(len(stringify(v.symbol))-1) {
 							return blank_value(), errors.New(fmt.Sprintf("error: index %d for string %s out of range", posv.number.intval, string(v.symbol)))
 						}
-						g := make([]rune, 0)
-						g = append(g, stringify(v.symbol)[posv.number.intval])
-						return value_symbol_init(g), nil
+						return value_char_init(stringify(v.symbol)[posv.number.intval]), nil
 					} else {
 						return blank_value(), errors.New("error: second argument to strindex must be int")
 					}
@@ -1066,16 +1850,824 @@ func strindexfunc(ast *tree, bindings *env) (value, error) {
 					return blank_value(), e2
 				}
 			} else {
-				return blank_value(), errors.New("error: first argument to strlen must be a symbol starting and ending with double quotes")
+				return blank_value(), errors.New("error: first argument to strindex must be a symbol starting and ending with double quotes")
 			}
 		} else {
-			return blank_value(), errors.New("error: first argument to strlen must be a symbol")
+			return blank_value(), errors.New("error: first argument to strindex must be a symbol")
 		}
 	} else {
 		return blank_value(), e
 	}
 }
 
+/* the characters with names, for #\\name literals and for printing */
+var char_names = map[string]rune{
+	"nul":       0,
+	"alarm":     7,
+	"backspace": 8,
+	"tab":       '\t',
+	"newline":   '\n',
+	"linefeed":  '\n',
+	"return":    '\r',
+	"escape":    27,
+	"space":     ' ',
+	"delete":    127,
+}
+
+func is_char_literal(sym []rune) bool {
+	return len(sym) > 2 && sym[0] == '#' && sym[1] == '\\'
+}
+
+/* char_literal reads #\a, #\space or #\x3bb */
+func char_literal(sym []rune) (value, error) {
+	name := sym[2:]
+	if len(name) == 1 {
+		return value_char_init(name[0]), nil
+	}
+	if r, ok := char_names[strings.ToLower(string(name))]; ok {
+		return value_char_init(r), nil
+	}
+	if name[0] == 'x' || name[0] == 'U' || name[0] == 'u' {
+		if n, e := strconv.ParseUint(string(name[1:]), 16, 32); e == nil && utf8.ValidRune(rune(n)) {
+			return value_char_init(rune(n)), nil
+		}
+	}
+	return blank_value(), new_error("parse-error", "unknown character %s", string(sym))
+}
+
+func char_string(r rune) string {
+	for _, name := range []string{"nul", "alarm", "backspace", "tab", "newline", "return", "escape", "space", "delete"} {
+		if char_names[name] == r {
+			return "#\\" + name
+		}
+	}
+	if !unicode.IsPrint(r) {
+		return fmt.Sprintf("#\\x%x", r)
+	}
+	return "#\\" + string(r)
+}
+
+func char_arg(v value, form string) (rune, error) {
+	if v.valtype != t_char {
+		return 0, new_error("type-error", "%s expects a char, given %s", form, type_name(v))
+	}
+	return v.symbol[0], nil
+}
+
+func charfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "char?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (char? value)")
+		}
+		if args[0].valtype == t_char {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "integer->char":
+		if len(args) != 1 || args[0].valtype != t_number_int {
+			return blank_value(), errors.New("usage: (integer->char n)")
+		}
+		n := args[0].number.intval
+		if n < 0 || n > unicode.MaxRune || !utf8.ValidRune(rune(n)) {
+			return blank_value(), new_error("range-error", "integer->char: %d isn't a character", n)
+		}
+		return value_char_init(rune(n)), nil
+	case "char=?", "char<?", "char>?", "char<=?", "char>=?":
+		/* (char<? a b c ...) holds when each is before the next */
+		if len(args) < 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s char1 char2[ char3 ...])", form))
+		}
+		rs := make([]rune, len(args))
+		for i, a := range args {
+			r, e1 := char_arg(a, form)
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			rs[i] = r
+		}
+		for i := 1; i < len(rs); i++ {
+			a, b := rs[i-1], rs[i]
+			ok := a == b
+			switch form {
+			case "char<?":
+				ok = a < b
+			case "char>?":
+				ok = a > b
+			case "char<=?":
+				ok = a <= b
+			case "char>=?":
+				ok = a >= b
+			}
+			if !ok {
+				return falsesym(), nil
+			}
+		}
+		return truesym(), nil
+	}
+	if len(args) != 1 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s char)", form))
+	}
+	r, e := char_arg(args[0], form)
+	if e != nil {
+		return blank_value(), e
+	}
+	test := func(b bool) (value, error) {
+		if b {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	switch form {
+	case "char->integer":
+		return value_number_int_init(int64(r)), nil
+	case "char-upcase":
+		return value_char_init(unicode.ToUpper(r)), nil
+	case "char-downcase":
+		return value_char_init(unicode.ToLower(r)), nil
+	case "char->string":
+		return string_value(string(r)), nil
+	case "char-alphabetic?":
+		return test(unicode.IsLetter(r))
+	case "char-numeric?":
+		return test(unicode.IsDigit(r))
+	case "char-whitespace?":
+		return test(unicode.IsSpace(r))
+	case "char-upper-case?":
+		return test(unicode.IsUpper(r))
+	case "char-lower-case?":
+		return test(unicode.IsLower(r))
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown char operation %s", form))
+}
+
+func string_arg(v value, form string) (string, error) {
+	if !is_string(v) {
+		return "", new_error("type-error", "%s expects a string, given %s", form, type_name(v))
+	}
+	return string(stringify(v.symbol)), nil
+}
+
+/* string_args checks that every one of args is a string */
+func string_args(args []value, form string) ([]string, error) {
+	strs := make([]string, len(args))
+	for i, a := range args {
+		s, e := string_arg(a, form)
+		if e != nil {
+			return nil, e
+		}
+		strs[i] = s
+	}
+	return strs, nil
+}
+
+func string_values(ss []string) value {
+	vals := make([]value, len(ss))
+	for i, x := range ss {
+		vals[i] = string_value(x)
+	}
+	return list_from_values(vals)
+}
+
+func radix_arg(args []value, form string) (int, error) {
+	if len(args) < 2 {
+		return 10, nil
+	}
+	if args[1].valtype != t_number_int || args[1].number.intval < 2 || args[1].number.intval > 36 {
+		return 0, new_error("range-error", "%s: radix must be an int from 2 to 36, given %s", form, value_string(args[1]))
+	}
+	return int(args[1].number.intval), nil
+}
+
+/* string positions count runes, like strindex and strlen */
+func stringfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	test := func(b bool) (value, error) {
+		if b {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	switch form {
+	case "string?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (string? value)")
+		}
+		return test(is_string(args[0]))
+	case "substring":
+		if len(args) != 2 && len(args) != 3 {
+			return blank_value(), errors.New("usage: (substring string start[ end])")
+		}
+		s, e1 := string_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		rs := []rune(s)
+		bounds := []int64{0, int64(len(rs))}
+		for i, a := range args[1:] {
+			if a.valtype != t_number_int {
+				return blank_value(), new_error("type-error", "substring expects int positions, given %s", type_name(a))
+			}
+			bounds[i] = a.number.intval
+		}
+		if bounds[0] < 0 || bounds[1] > int64(len(rs)) || bounds[0] > bounds[1] {
+			return blank_value(), new_error("range-error", "substring %d to %d out of range for string of length %d", bounds[0], bounds[1], len(rs))
+		}
+		return string_value(string(rs[bounds[0]:bounds[1]])), nil
+	case "string-split":
+		/* without a separator, splits around runs of whitespace */
+		if len(args) != 1 && len(args) != 2 {
+			return blank_value(), errors.New("usage: (string-split string[ separator])")
+		}
+		strs, e1 := string_args(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if len(strs) == 1 {
+			return string_values(strings.Fields(strs[0])), nil
+		}
+		if strs[1] == "" {
+			return blank_value(), new_error("range-error", "string-split: the separator can't be empty")
+		}
+		return string_values(strings.Split(strs[0], strs[1])), nil
+	case "string-join":
+		if len(args) != 1 && len(args) != 2 {
+			return blank_value(), errors.New("usage: (string-join (list string ...)[ separator])")
+		}
+		vals, e1 := list_values(args[0])
+		if e1 != nil {
+			return blank_value(), new_error("type-error", "string-join expects a list, given %s", type_name(args[0]))
+		}
+		parts, e1 := string_args(vals, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		sep := " "
+		if len(args) == 2 {
+			if sep, e1 = string_arg(args[1], form); e1 != nil {
+				return blank_value(), e1
+			}
+		}
+		return string_value(strings.Join(parts, sep)), nil
+	case "string-trim":
+		/* (string-trim s) trims whitespace; (string-trim s "-_") trims those characters */
+		if len(args) != 1 && len(args) != 2 {
+			return blank_value(), errors.New("usage: (string-trim string[ characters])")
+		}
+		strs, e1 := string_args(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if len(strs) == 1 {
+			return string_value(strings.TrimSpace(strs[0])), nil
+		}
+		return string_value(strings.Trim(strs[0], strs[1])), nil
+	case "string-upcase", "string-downcase":
+		if len(args) != 1 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s string)", form))
+		}
+		s, e1 := string_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if form == "string-upcase" {
+			return string_value(strings.ToUpper(s)), nil
+		}
+		return string_value(strings.ToLower(s)), nil
+	case "string-contains", "string-index-of", "string-prefix?", "string-suffix?":
+		if len(args) != 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s string part)", form))
+		}
+		strs, e1 := string_args(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		switch form {
+		case "string-contains":
+			return test(strings.Contains(strs[0], strs[1]))
+		case "string-prefix?":
+			return test(strings.HasPrefix(strs[0], strs[1]))
+		case "string-suffix?":
+			return test(strings.HasSuffix(strs[0], strs[1]))
+		}
+		/* where part first turns up, or #f */
+		i := strings.Index(strs[0], strs[1])
+		if i < 0 {
+			return falsesym(), nil
+		}
+		return value_number_int_init(int64(utf8.RuneCountInString(strs[0][:i]))), nil
+	case "string-replace":
+		/* every occurrence */
+		if len(args) != 3 {
+			return blank_value(), errors.New("usage: (string-replace string old new)")
+		}
+		strs, e1 := string_args(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		return string_value(strings.ReplaceAll(strs[0], strs[1], strs[2])), nil
+	case "string->list":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (string->list string)")
+		}
+		s, e1 := string_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		vals := make([]value, 0)
+		for _, r := range s {
+			vals = append(vals, value_char_init(r))
+		}
+		return list_from_values(vals), nil
+	case "list->string":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (list->string (list char ...))")
+		}
+		vals, e1 := list_values(args[0])
+		if e1 != nil {
+			return blank_value(), new_error("type-error", "list->string expects a list, given %s", type_name(args[0]))
+		}
+		rs := make([]rune, len(vals))
+		for i, v := range vals {
+			r, e2 := char_arg(v, form)
+			if e2 != nil {
+				return blank_value(), e2
+			}
+			rs[i] = r
+		}
+		return string_value(string(rs)), nil
+	case "string->number":
+		/* #f when the string isn't a number */
+		if len(args) != 1 && len(args) != 2 {
+			return blank_value(), errors.New("usage: (string->number string[ radix])")
+		}
+		s, e1 := string_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		radix, e1 := radix_arg(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if n, e2 := strconv.ParseInt(s, radix, 64); e2 == nil {
+			return value_number_int_init(n), nil
+		}
+		if f, e2 := strconv.ParseFloat(s, 64); e2 == nil && radix == 10 {
+			return value_number_float_init(f), nil
+		}
+		return falsesym(), nil
+	case "number->string":
+		if len(args) != 1 && len(args) != 2 {
+			return blank_value(), errors.New("usage: (number->string number[ radix])")
+		}
+		radix, e1 := radix_arg(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		n := args[0]
+		switch {
+		case n.valtype == t_number_int:
+			return string_value(strconv.FormatInt(n.number.intval, radix)), nil
+		case n.valtype != t_number_float && n.valtype != t_number_rat:
+			return blank_value(), new_error("type-error", "number->string expects a number, given %s", type_name(n))
+		case radix != 10:
+			return blank_value(), new_error("range-error", "number->string: only ints can be written in radix %d", radix)
+		case n.valtype == t_number_float:
+			return string_value(strconv.FormatFloat(n.number.floatval, 'g', -1, 64)), nil
+		}
+		return string_value(fmt.Sprintf("%d/%d", n.number.ratval.num, n.number.ratval.den)), nil
+	case "string=?", "string<?", "string>?", "string<=?", "string>=?":
+		/* (string<? a b c ...) holds when each is before the next; strings
+		compare by code point, as their UTF-8 bytes do */
+		if len(args) < 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s string1 string2[ string3 ...])", form))
+		}
+		strs, e1 := string_args(args, form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		for i := 1; i < len(strs); i++ {
+			c := strings.Compare(strs[i-1], strs[i])
+			ok := c == 0
+			switch form {
+			case "string<?":
+				ok = c < 0
+			case "string>?":
+				ok = c > 0
+			case "string<=?":
+				ok = c <= 0
+			case "string>=?":
+				ok = c >= 0
+			}
+			if !ok {
+				return falsesym(), nil
+			}
+		}
+		return truesym(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown string operation %s", form))
+}
+
+// every pattern is compiled once, whether it came from a #rx"..."
+// literal or was given to a regexp function as a string
+var regexps sync.Map
+
+func compile_regexp(pattern string) (*regexp.Regexp, error) {
+	if rx, ok := regexps.Load(pattern); ok {
+		return rx.(*regexp.Regexp), nil
+	}
+	rx, e := regexp.Compile(pattern)
+	if e != nil {
+		return nil, new_error("regexp-error", "bad regular expression %q: %s", pattern, e.Error())
+	}
+	regexps.Store(pattern, rx)
+	return rx, nil
+}
+
+func is_regexp_literal(sym []rune) bool {
+	return len(sym) >= 5 && string(sym[:4]) == "#rx\"" && sym[len(sym)-1] == '"'
+}
+
+func regexp_literal(sym []rune) (value, error) {
+	rx, e := compile_regexp(string(sym[4 : len(sym)-1]))
+	if e != nil {
+		return blank_value(), e
+	}
+	return value_regexp_init(rx), nil
+}
+
+/* regexp_arg takes either a regexp or a string to compile */
+func regexp_arg(v value, form string) (*regexp.Regexp, error) {
+	if v.valtype == t_regexp {
+		return v.rx(), nil
+	}
+	if is_string(v) {
+		return compile_regexp(string(stringify(v.symbol)))
+	}
+	return nil, new_error("type-error", "%s expects a regexp, given %s", form, type_name(v))
+}
+
+// match_groups is what regexp-match gives for one match: the whole of
+// it, then each group, with #f for groups that didn't take part
+func match_groups(s string, loc []int) value {
+	vals := make([]value, 0, len(loc)/2)
+	for i := 0; i < len(loc); i += 2 {
+		if loc[i] < 0 {
+			vals = append(vals, falsesym())
+		} else {
+			vals = append(vals, string_value(s[loc[i]:loc[i+1]]))
+		}
+	}
+	return list_from_values(vals)
+}
+
+func regexpfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "regexp":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (regexp \"pattern\")")
+		}
+		s, e1 := string_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		rx, e1 := compile_regexp(s)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		return value_regexp_init(rx), nil
+	case "regexp?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (regexp? value)")
+		}
+		if args[0].valtype == t_regexp {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "regexp-replace":
+		/* (regexp-replace rx s "$1-$2") or (regexp-replace rx s f), where f
+		gets the match and its groups and gives back a string */
+		if len(args) != 3 {
+			return blank_value(), errors.New("usage: (regexp-replace regexp string replacement)")
+		}
+		rx, e1 := regexp_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		s, e1 := string_arg(args[1], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if is_string(args[2]) {
+			return string_value(rx.ReplaceAllString(s, string(stringify(args[2].symbol)))), nil
+		}
+		var b strings.Builder
+		last := 0
+		for _, loc := range rx.FindAllStringSubmatchIndex(s, -1) {
+			groups, _ := list_values(match_groups(s, loc))
+			r, e2 := applyfn(args[2], groups, bindings)
+			if e2 != nil {
+				return blank_value(), e2
+			}
+			rs, e2 := string_arg(r, form)
+			if e2 != nil {
+				return blank_value(), e2
+			}
+			b.WriteString(s[last:loc[0]])
+			b.WriteString(rs)
+			last = loc[1]
+		}
+		b.WriteString(s[last:])
+		return string_value(b.String()), nil
+	}
+	if len(args) != 2 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s regexp string)", form))
+	}
+	rx, e := regexp_arg(args[0], form)
+	if e != nil {
+		return blank_value(), e
+	}
+	s, e := string_arg(args[1], form)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "regexp-match":
+		/* #f if it doesn't match */
+		loc := rx.FindStringSubmatchIndex(s)
+		if loc == nil {
+			return falsesym(), nil
+		}
+		return match_groups(s, loc), nil
+	case "regexp-match-all":
+		matches := make([]value, 0)
+		for _, loc := range rx.FindAllStringSubmatchIndex(s, -1) {
+			matches = append(matches, match_groups(s, loc))
+		}
+		return list_from_values(matches), nil
+	case "regexp-split":
+		return string_values(rx.Split(s, -1)), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown regexp operation %s", form))
+}
+
+// display_string is how ~a shows a value: strings and characters as
+// their text alone, anything else the way the repl prints it
+func display_string(v value) string {
+	switch {
+	case is_string(v):
+		return string(stringify(v.symbol))
+	case v.valtype == t_char:
+		return string(v.symbol[0])
+	}
+	return value_string(v)
+}
+
+/* pad makes s at least width runes wide with c, on the left or right */
+func pad(s string, width int, c rune, left bool) string {
+	n := width - utf8.RuneCountInString(s)
+	if n <= 0 {
+		return s
+	}
+	if left {
+		return strings.Repeat(string(c), n) + s
+	}
+	return s + strings.Repeat(string(c), n)
+}
+
+// a formatter works through a format control string, taking arguments
+// as its directives ask for them
+type formatter struct {
+	form string
+	args []value
+	next int
+}
+
+func (f *formatter) arg() (value, error) {
+	if f.next >= len(f.args) {
+		return blank_value(), errors.New(fmt.Sprintf("error: %s: not enough arguments for the control string", f.form))
+	}
+	f.next++
+	return f.args[f.next-1], nil
+}
+
+// run writes ctl, with its directives filled in, to b. It gives back true
+// if it stopped at a ~^ because there were no arguments left
+func (f *formatter) run(b *strings.Builder, ctl []rune) (bool, error) {
+	for i := 0; i < len(ctl); i++ {
+		if ctl[i] != '~' {
+			b.WriteRune(ctl[i])
+			continue
+		}
+		/* parameters come between the ~ and the directive, separated by
+		commas: numbers, or a character after a ' */
+		params := []string{""}
+		for i++; i < len(ctl); i++ {
+			switch {
+			case ctl[i] == ',':
+				params = append(params, "")
+				continue
+			case ctl[i] == '\'' && i+1 < len(ctl):
+				params[len(params)-1] = string(ctl[i : i+2])
+				i++
+				continue
+			case unicode.IsDigit(ctl[i]) || ctl[i] == '-':
+				params[len(params)-1] += string(ctl[i])
+				continue
+			}
+			break
+		}
+		if i == len(ctl) {
+			return false, errors.New(fmt.Sprintf("error: %s: control string ends in the middle of a directive", f.form))
+		}
+		num := func(n int, def int) (int, error) {
+			if n >= len(params) || params[n] == "" {
+				return def, nil
+			}
+			x, e := strconv.Atoi(params[n])
+			if e != nil {
+				return 0, errors.New(fmt.Sprintf("error: %s: bad parameter %s to ~%c", f.form, params[n], ctl[i]))
+			}
+			return x, nil
+		}
+		char := func(n int) rune {
+			if n < len(params) && len(params[n]) == 2 && params[n][0] == '\'' {
+				return []rune(params[n])[1]
+			}
+			return ' '
+		}
+		switch d := unicode.ToLower(ctl[i]); d {
+		case 'a', 's':
+			/* ~10a pads on the right to 10 characters */
+			v, e := f.arg()
+			if e != nil {
+				return false, e
+			}
+			width, e := num(0, 0)
+			if e != nil {
+				return false, e
+			}
+			s := value_string(v)
+			if d == 'a' {
+				s = display_string(v)
+			}
+			b.WriteString(pad(s, width, char(1), false))
+		case 'd', 'b', 'o', 'x', 'r':
+			/* ~5,'0d pads on the left; ~16r gives the radix itself */
+			v, e := f.arg()
+			if e != nil {
+				return false, e
+			}
+			radix := map[rune]int{'d': 10, 'b': 2, 'o': 8, 'x': 16}[d]
+			first := 0
+			if d == 'r' {
+				if radix, e = num(0, 10); e != nil {
+					return false, e
+				}
+				if radix < 2 || radix > 36 {
+					return false, new_error("range-error", "%s: radix must be from 2 to 36, given %d", f.form, radix)
+				}
+				first = 1
+			}
+			width, e := num(first, 0)
+			if e != nil {
+				return false, e
+			}
+			s := display_string(v)
+			if v.valtype == t_number_int {
+				s = strconv.FormatInt(v.number.intval, radix)
+			}
+			b.WriteString(pad(s, width, char(first+1), true))
+		case 'f':
+			/* ~8,2f: 8 wide, 2 digits after the point */
+			v, e := f.arg()
+			if e != nil {
+				return false, e
+			}
+			width, e := num(0, 0)
+			if e != nil {
+				return false, e
+			}
+			digits, e := num(1, -1)
+			if e != nil {
+				return false, e
+			}
+			s := display_string(v)
+			switch v.valtype {
+			case t_number_int, t_number_float, t_number_rat:
+				s = strconv.FormatFloat(num2float(v), 'f', digits, 64)
+			}
+			b.WriteString(pad(s, width, char(2), true))
+		case 'c':
+			v, e := f.arg()
+			if e != nil {
+				return false, e
+			}
+			r, e := char_arg(v, f.form)
+			if e != nil {
+				return false, e
+			}
+			b.WriteRune(r)
+		case '%', '~':
+			n, e := num(0, 1)
+			if e != nil {
+				return false, e
+			}
+			out := "\n"
+			if d == '~' {
+				out = "~"
+			}
+			b.WriteString(strings.Repeat(out, n))
+		case '^':
+			if f.next >= len(f.args) {
+				return true, nil
+			}
+		case '{':
+			/* ~{...~} formats the body with the members of a list as its
+			arguments, over and over until they run out */
+			depth, end := 1, -1
+			for j := i + 1; j+1 < len(ctl) && end < 0; j++ {
+				if ctl[j] != '~' {
+					continue
+				}
+				k := j + 1
+				for k < len(ctl) && (ctl[k] == ',' || ctl[k] == '\'' || ctl[k] == '-' || unicode.IsDigit(ctl[k])) {
+					if ctl[k] == '\'' {
+						k++
+					}
+					k++
+				}
+				if k < len(ctl) && ctl[k] == '{' {
+					depth++
+				} else if k < len(ctl) && ctl[k] == '}' {
+					if depth--; depth == 0 {
+						end = j
+					}
+				}
+				j = k
+			}
+			if end < 0 {
+				return false, errors.New(fmt.Sprintf("error: %s: ~{ without a ~}", f.form))
+			}
+			v, e := f.arg()
+			if e != nil {
+				return false, e
+			}
+			items, e := list_values(v)
+			if e != nil {
+				return false, new_error("type-error", "%s: ~{ expects a list, given %s", f.form, type_name(v))
+			}
+			sub := &formatter{f.form, items, 0}
+			for sub.next < len(sub.args) {
+				before := sub.next
+				stop, e1 := sub.run(b, ctl[i+1:end])
+				if e1 != nil {
+					return false, e1
+				}
+				if stop || sub.next == before {
+					break
+				}
+			}
+			i = end + 1
+		default:
+			return false, errors.New(fmt.Sprintf("error: %s: unknown directive ~%c", f.form, ctl[i]))
+		}
+	}
+	return false, nil
+}
+
+func formatfunc(ast *tree, bindings *env, form string) (value, error) {
+	/* (format "~a is ~,2f~%" x y); printf writes the same to standard output */
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if len(args) == 0 || !is_string(args[0]) {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s \"control string\"[ arg ...])", form))
+	}
+	var b strings.Builder
+	f := &formatter{form, args[1:], 0}
+	if _, e1 := f.run(&b, stringify(args[0].symbol)); e1 != nil {
+		return blank_value(), e1
+	}
+	if form == "printf" {
+		fmt.Print(b.String())
+		return blank_value(), nil
+	}
+	return string_value(b.String()), nil
+}
+
 func strlenfunc(ast *tree, bindings *env) (value, error) {
 	if ast.next == nil {
 		return blank_value(), errors.New("usage: (strlen \"my string\")")
@@ -1095,170 +2687,4838 @@ func strlenfunc(ast *tree, bindings *env) (value, error) {
 	}
 }
 
-/* cat -> tree lol */
-func cat(ast *tree, bindings *env, ret []rune) ([]rune, error) {
-	if ast.next == nil {
-		//fmt.Println("length of ret is ", len(ret))
-		u := make([]rune, 1)
-		u[0] = '"'
-		for _, x := range ret {
-			u = append(u, x)
+/* cat -> tree lol */
+func cat(ast *tree, bindings *env, ret []rune) ([]rune, error) {
+	if ast.next == nil {
+		//fmt.Println("length of ret is ", len(ret))
+		u := make([]rune, 1)
+		u[0] = '"'
+		for _, x := range ret {
+			u = append(u, x)
+		}
+		u = append(u, '"')
+		return u, nil
+	}
+	if v, e := eval2(ast.next, bindings); e == nil {
+		if v.valtype == t_symbol || v.valtype == t_head_symbol {
+			if symisstring(v.symbol) {
+				//g := ret+v.symbol
+				//ret = make([]rune, len(v.symbol)+len(ret))
+				for _, r := range stringify(v.symbol) {
+					ret = append(ret, r)
+				}
+				return cat(ast.next, bindings, ret)
+			} else {
+				return ret, errors.New("error: arguments to strcat must be symbols starting and ending with double quotes")
+			}
+		} else {
+			return ret, errors.New("error: arguments to strcat must be symbols")
+		}
+	} else {
+		return ret, e
+	}
+}
+
+func strcatfunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil || ast.next.next == nil {
+		return blank_value(), errors.New("usage: (strcat \"str1\" \"str2\"[ \"str3\" ...])")
+	}
+	if result, e := cat(ast, bindings, make([]rune, 0)); e == nil {
+		//fmt.Println(string(result))
+		return value_symbol_init(result), nil
+	} else {
+		return blank_value(), e
+	}
+	return blank_value(), nil
+}
+
+func intfunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (int value)")
+	}
+	if v, e := eval2(ast.next, bindings); e == nil {
+		switch v.valtype {
+		case t_symbol:
+			if symisstring(v.symbol) {
+				if len(stringify(v.symbol)) == 1 {
+					return value_number_int_init(int64(stringify(v.symbol)[0])), nil
+				}
+			}
+		case t_char:
+			return value_number_int_init(int64(v.symbol[0])), nil
+		}
+	}
+	return blank_value(), nil
+}
+
+func collect_bools(ast *tree, bindings *env, ret []bool) ([]bool, error) {
+	if v, e0 := eval2(ast, bindings); e0 == nil {
+		if b, e := istrue(v, bindings); e == nil {
+			if ast.next != nil {
+				return collect_bools(ast.next, bindings, append(ret, b))
+			} else {
+				return append(ret, b), nil
+			}
+		} else {
+			return nil, e
+		}
+	} else {
+		return nil, e0
+	}
+}
+
+func nandfunc(ast *tree, bindings *env) (value, error) {
+	fmt.Println("nanding")
+	print_tree(ast)
+	if ast.next == nil || ast.next.next == nil {
+		return blank_value(), errors.New("usage: (nand bool1 bool2[ bool3 bool4 ...])")
+	}
+	if bs, e := collect_bools(ast.next, bindings, make([]bool, 0)); e == nil {
+		fmt.Println(bs)
+		for _, b := range bs {
+			if !b {
+				return truesym(), nil
+			}
+		}
+		return falsesym(), nil
+	} else {
+		return falsesym(), e
+	}
+}
+
+func vals2list(vs []value, i int, target *tree) {
+	target.val = vs[i]
+	if i != len(vs)-1 {
+		target.next = &tree{blank_value(), true, nil, nil}
+		vals2list(vs, i+1, target.next)
+	}
+}
+
+func applyeach(fn value, l *tree, b *env, acc []value) ([]value, error) {
+	print_value(l.val)
+	print_tree(&tree{value_ast_init(&tree{fn, true, &tree{l.val, true, nil, nil}, nil}), true, nil, nil})
+	if r, e := eval2(&tree{value_ast_init(&tree{fn, true, &tree{l.val, true, nil, nil}, nil}), true, nil, nil}, b); e == nil {
+		//if r, e := eval2(&tree{fn, true, &tree{l.val, true, nil, nil}, nil}, b); e == nil {
+		print_value(r)
+		acc = append(acc, r)
+	} else {
+		return make([]value, 0), e
+	}
+	if l.next != nil {
+		return applyeach(fn, l.next, b, acc)
+	} else {
+		return acc, nil
+	}
+}
+
+func dofor(ast *tree, bindings *env) (value, error) {
+	if ast.next != nil && ast.next.next != nil {
+		if fn, ev := eval2(ast.next, bindings); ev == nil {
+			print_value(fn)
+			if v, e0 := eval2(ast.next.next, bindings); e0 == nil {
+				if v.valtype == t_tree {
+					vals, e1 := applyeach(fn, v.ast.val.ast, bindings, make([]value, 0))
+					if e1 == nil {
+						x := tree{blank_value(), true, nil, nil}
+						vals2list(vals, 0, &x)
+						return value_ast_init(&tree{value_ast_init(&x), true, nil, nil}), nil
+					} else {
+						return blank_value(), e1
+					}
+				} else {
+					return blank_value(), errors.New("error: second argument to dofor must be list")
+				}
+			} else {
+				return blank_value(), e0
+			}
+		} else {
+			return blank_value(), ev
+		}
+	} else {
+		return blank_value(), errors.New("usage: (dofor fn (list x[ y z ...]))")
+	}
+}
+
+// list_values flattens a list value into a slice; it copes with both the
+// (list ...) shape, where the members hang off a single inner tree, and the
+// flat shape produced by quote
+func list_values(v value) ([]value, error) {
+	if v.valtype != t_tree {
+		return nil, errors.New(fmt.Sprintf("error: expected list, got %s", typenames[v.valtype]))
+	}
+	vals := make([]value, 0)
+	if v.ast == nil {
+		return vals, nil
+	}
+	members := v.ast
+	if v.ast.next == nil && v.ast.val.valtype == t_tree {
+		members = v.ast.val.ast
+	}
+	for m := members; m != nil; m = m.next {
+		vals = append(vals, m.val)
+	}
+	return vals, nil
+}
+
+/* list_from_values builds a list value in the same shape as (list ...) */
+func list_from_values(vs []value) value {
+	if len(vs) == 0 {
+		return value_ast_init(&tree{value_ast_init(nil), true, nil, nil})
+	}
+	x := tree{blank_value(), true, nil, nil}
+	vals2list(vs, 0, &x)
+	return value_ast_init(&tree{value_ast_init(&x), true, nil, nil})
+}
+
+func setfunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil || ast.next.next == nil {
+		return blank_value(), errors.New("usage: (set! my-symbol value)")
+	}
+	if !is_symbol(ast.next.val) {
+		return blank_value(), errors.New(fmt.Sprintf("error: set! can't bind to a non-symbol (%s)", typenames[ast.next.val.valtype]))
+	}
+	g, e := eval2(ast.next.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	name := string(ast.next.val.symbol)
+	if bindings.update(name, g) {
+		return g, nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: set! of unbound symbol %s", name))
+}
+
+func numcmpfunc(ast *tree, bindings *env, op string) (value, error) {
+	if ast.next == nil || ast.next.next == nil {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s number1 number2[ number3 ...])", op))
+	}
+	vlist, err := collect_number_values(ast.next, bindings, make([]value, 0))
+	if err != nil {
+		return blank_value(), err
+	}
+	for i := 1; i < len(vlist); i++ {
+		c := 0
+		if number_result(vlist[i-1:i+1]) == t_number_int {
+			a, b := num2int(vlist[i-1]), num2int(vlist[i])
+			if a < b {
+				c = -1
+			} else if a > b {
+				c = 1
+			}
+		} else {
+			a, b := num2float(vlist[i-1]), num2float(vlist[i])
+			if a < b {
+				c = -1
+			} else if a > b {
+				c = 1
+			}
+		}
+		ok := false
+		switch op {
+		case "<":
+			ok = c < 0
+		case ">":
+			ok = c > 0
+		case "<=":
+			ok = c <= 0
+		case ">=":
+			ok = c >= 0
+		}
+		if !ok {
+			return falsesym(), nil
+		}
+	}
+	return truesym(), nil
+}
+
+/* the loop forms below all iterate with a Go for loop rather than by
+recursing through eval2, so a long-running loop doesn't grow the stack */
+
+func whilefunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil || ast.next.next == nil {
+		return blank_value(), errors.New("usage: (while condition body[ body ...])")
+	}
+	for {
+		v, e := eval2(ast.next, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		if t, e2 := istrue(v, bindings); e2 != nil {
+			return blank_value(), e2
+		} else if !t {
+			return blank_value(), nil
+		}
+		if _, e3 := prognfunc(ast.next.next, bindings); e3 != nil {
+			return blank_value(), e3
+		}
+	}
+}
+
+// loop_spec picks apart the (var value[ result]) header shared by dotimes
+// and dolist
+func loop_spec(ast *tree, form string) ([]rune, *tree, *tree, error) {
+	usage := errors.New(fmt.Sprintf("usage: (%s (var value[ result]) body[ body ...])", form))
+	if ast.next == nil || ast.next.val.valtype != t_tree || ast.next.val.ast == nil {
+		return nil, nil, nil, usage
+	}
+	spec := ast.next.val.ast
+	if !is_symbol(spec.val) || spec.next == nil {
+		return nil, nil, nil, usage
+	}
+	return spec.val.symbol, spec.next, spec.next.next, nil
+}
+
+func dotimesfunc(ast *tree, bindings *env) (value, error) {
+	name, count, result, err := loop_spec(ast, "dotimes")
+	if err != nil {
+		return blank_value(), err
+	}
+	n, e := eval2(count, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if n.valtype != t_number_int {
+		return blank_value(), errors.New(fmt.Sprintf("error: dotimes count must be int, given %s", typenames[n.valtype]))
+	}
+	local := new_env(make(map[string]value), bindings)
+	for i := int64(0); i < n.number.intval; i++ {
+		local.set(string(name), value_number_int_init(i))
+		if ast.next.next != nil {
+			if _, e2 := prognfunc(ast.next.next, local); e2 != nil {
+				return blank_value(), e2
+			}
+		}
+	}
+	if result != nil {
+		local.set(string(name), n)
+		return eval2(result, local)
+	}
+	return blank_value(), nil
+}
+
+func dolistfunc(ast *tree, bindings *env) (value, error) {
+	name, lst, result, err := loop_spec(ast, "dolist")
+	if err != nil {
+		return blank_value(), err
+	}
+	l, e := eval2(lst, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	vals, e1 := list_values(l)
+	if e1 != nil {
+		return blank_value(), errors.New("error: second item in dolist header must be list")
+	}
+	local := new_env(make(map[string]value), bindings)
+	for _, v := range vals {
+		local.set(string(name), v)
+		if ast.next.next != nil {
+			if _, e2 := prognfunc(ast.next.next, local); e2 != nil {
+				return blank_value(), e2
+			}
+		}
+	}
+	if result != nil {
+		local.set(string(name), value_ast_init(&tree{value_ast_init(nil), true, nil, nil}))
+		return eval2(result, local)
+	}
+	return blank_value(), nil
+}
+
+func dofunc(ast *tree, bindings *env) (value, error) {
+	/* (do ((var init step) ...) (test result ...) body ...) */
+	usage := errors.New("usage: (do ((var1 init1[ step1]) ...) (test[ result ...]) body ...)")
+	if ast.next == nil || ast.next.next == nil || ast.next.val.valtype != t_tree || ast.next.next.val.valtype != t_tree || ast.next.next.val.ast == nil {
+		return blank_value(), usage
+	}
+	names := make([][]rune, 0)
+	steps := make([]*tree, 0)
+	local := new_env(make(map[string]value), bindings)
+	for b := ast.next.val.ast; b != nil; b = b.next {
+		if b.val.valtype != t_tree || b.val.ast == nil || !is_symbol(b.val.ast.val) || b.val.ast.next == nil {
+			return blank_value(), usage
+		}
+		v, e := eval2(b.val.ast.next, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		names = append(names, b.val.ast.val.symbol)
+		steps = append(steps, b.val.ast.next.next)
+		local.set(string(b.val.ast.val.symbol), v)
+	}
+	test := ast.next.next.val.ast
+	for {
+		t, e := eval2(test, local)
+		if e != nil {
+			return blank_value(), e
+		}
+		if done, e1 := istrue(t, local); e1 != nil {
+			return blank_value(), e1
+		} else if done {
+			if test.next != nil {
+				return prognfunc(test.next, local)
+			}
+			return blank_value(), nil
+		}
+		if ast.next.next.next != nil {
+			if _, e2 := prognfunc(ast.next.next.next, local); e2 != nil {
+				return blank_value(), e2
+			}
+		}
+		/* every step is computed before any variable is updated */
+		stepped := make([]value, len(names))
+		for i, s := range steps {
+			if s == nil {
+				stepped[i], _ = local.get(string(names[i]))
+				continue
+			}
+			v, e3 := eval2(s, local)
+			if e3 != nil {
+				return blank_value(), e3
+			}
+			stepped[i] = v
+		}
+		for i, n := range names {
+			local.set(string(n), stepped[i])
+		}
+	}
+}
+
+// sequence_values gives the members a for clause iterates over: an int n
+// counts 0 to n-1, anything else must be a list
+func sequence_values(v value) ([]value, error) {
+	if v.valtype == t_number_int {
+		vals := make([]value, 0)
+		for i := int64(0); i < v.number.intval; i++ {
+			vals = append(vals, value_number_int_init(i))
+		}
+		return vals, nil
+	}
+	if v.valtype == t_hash {
+		return hash_items(v.hash(), "hash->list"), nil
+	}
+	if v.valtype == t_vector {
+		return v.vector().snapshot(), nil
+	}
+	if v.valtype == t_pmap || v.valtype == t_pvec {
+		return persistent_items(v), nil
+	}
+	if vals, e := list_values(v); e == nil {
+		return vals, nil
+	}
+	return nil, errors.New(fmt.Sprintf("error: can't iterate over %s", typenames[v.valtype]))
+}
+
+func arith_values(a value, b value, op string) (value, error) {
+	for _, v := range []value{a, b} {
+		if v.valtype != t_number_int && v.valtype != t_number_float && v.valtype != t_number_rat {
+			return blank_value(), errors.New(fmt.Sprintf("error: expected number, got %s", typenames[v.valtype]))
+		}
+	}
+	if number_result([]value{a, b}) == t_number_int {
+		if op == "*" {
+			return value_number_int_init(num2int(a) * num2int(b)), nil
+		}
+		return value_number_int_init(num2int(a) + num2int(b)), nil
+	}
+	if op == "*" {
+		return value_number_float_init(num2float(a) * num2float(b)), nil
+	}
+	return value_number_float_init(num2float(a) + num2float(b)), nil
+}
+
+// a for clause is either a generator (name sequence) or a
+// #:when/#:unless guard
+type for_clause struct {
+	name  []rune
+	expr  *tree
+	guard string
+}
+
+func for_clauses(c *tree) ([]for_clause, error) {
+	clauses := make([]for_clause, 0)
+	for ; c != nil; c = c.next {
+		if is_symbol(c.val) && (string(c.val.symbol) == "#:when" || string(c.val.symbol) == "#:unless") {
+			if c.next == nil {
+				return nil, errors.New(fmt.Sprintf("error: %s in for clauses needs an expression", string(c.val.symbol)))
+			}
+			clauses = append(clauses, for_clause{nil, c.next, string(c.val.symbol)})
+			c = c.next
+			continue
+		}
+		if c.val.valtype != t_tree || c.val.ast == nil || !is_symbol(c.val.ast.val) || c.val.ast.next == nil {
+			return nil, errors.New("error: for clause must look like (name sequence), #:when test or #:unless test")
+		}
+		clauses = append(clauses, for_clause{c.val.ast.val.symbol, c.val.ast.next, ""})
+	}
+	return clauses, nil
+}
+
+// for_walk runs each once for every binding the clauses produce.
+// Neighbouring generators step in parallel (stopping at the shortest) unless
+// nested is set, as in for*; a guard always nests whatever follows it.
+// each returns true to stop the whole iteration early.
+func for_walk(clauses []for_clause, nested bool, bindings *env, each func(*env) (bool, error)) (bool, error) {
+	if len(clauses) == 0 {
+		return each(bindings)
+	}
+	if clauses[0].guard != "" {
+		v, e := eval2(clauses[0].expr, bindings)
+		if e != nil {
+			return false, e
+		}
+		t, e1 := istrue(v, bindings)
+		if e1 != nil {
+			return false, e1
+		}
+		if t != (clauses[0].guard == "#:when") {
+			return false, nil
+		}
+		return for_walk(clauses[1:], nested, bindings, each)
+	}
+	n := 1
+	for !nested && n < len(clauses) && clauses[n].guard == "" {
+		n++
+	}
+	seqs := make([][]value, n)
+	shortest := -1
+	for i, c := range clauses[:n] {
+		v, e := eval2(c.expr, bindings)
+		if e != nil {
+			return false, e
+		}
+		if seqs[i], e = sequence_values(v); e != nil {
+			return false, e
+		}
+		if shortest == -1 || len(seqs[i]) < shortest {
+			shortest = len(seqs[i])
+		}
+	}
+	local := new_env(make(map[string]value), bindings)
+	for j := 0; j < shortest; j++ {
+		for i, c := range clauses[:n] {
+			local.set(string(c.name), seqs[i][j])
+		}
+		if stop, e := for_walk(clauses[n:], nested, local, each); e != nil || stop {
+			return stop, e
+		}
+	}
+	return false, nil
+}
+
+func forfunc(ast *tree, bindings *env, form string) (value, error) {
+	/* (for/list ((x xs) (y ys) #:when (< x y)) body ...)
+	(for/fold ((acc init) ...) (clauses) body ...) */
+	kind := ""
+	if i := strings.Index(form, "/"); i != -1 {
+		kind = form[i+1:]
+	}
+	nested := strings.HasPrefix(form, "for*")
+	header := ast.next
+	accs := make([][]rune, 0)
+	local := bindings
+	if kind == "fold" {
+		if ast.next == nil || ast.next.val.valtype != t_tree {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s ((acc init) ...) (clause ...) body ...)", form))
+		}
+		local = new_env(make(map[string]value), bindings)
+		for a := ast.next.val.ast; a != nil; a = a.next {
+			if a.val.valtype != t_tree || a.val.ast == nil || !is_symbol(a.val.ast.val) || a.val.ast.next == nil {
+				return blank_value(), errors.New(fmt.Sprintf("error: %s accumulator must look like (name init)", form))
+			}
+			v, e := eval2(a.val.ast.next, bindings)
+			if e != nil {
+				return blank_value(), e
+			}
+			accs = append(accs, a.val.ast.val.symbol)
+			local.set(string(a.val.ast.val.symbol), v)
+		}
+		header = ast.next.next
+	}
+	if header == nil || header.val.valtype != t_tree || header.next == nil {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s (clause ...) body ...)", form))
+	}
+	clauses, err := for_clauses(header.val.ast)
+	if err != nil {
+		return blank_value(), err
+	}
+	body := header.next
+	collected := make([]value, 0)
+	result := blank_value()
+	switch kind {
+	case "sum":
+		result = value_number_int_init(0)
+	case "product":
+		result = value_number_int_init(1)
+	case "and":
+		result = truesym()
+	case "or":
+		result = falsesym()
+	}
+	_, err = for_walk(clauses, nested, local, func(b *env) (bool, error) {
+		v, e := prognfunc(body, b)
+		if e != nil {
+			return true, e
+		}
+		switch kind {
+		case "list":
+			collected = append(collected, v)
+		case "sum":
+			result, e = arith_values(result, v, "+")
+		case "product":
+			result, e = arith_values(result, v, "*")
+		case "and", "or":
+			t, e1 := istrue(v, b)
+			if e1 != nil {
+				return true, e1
+			}
+			if kind == "and" {
+				result = v
+				return !t, nil
+			}
+			if t {
+				result = v
+				return true, nil
+			}
+		case "fold":
+			if len(accs) == 1 {
+				local.set(string(accs[0]), v)
+				return false, nil
+			}
+			vals, e1 := list_values(v)
+			if e1 != nil || len(vals) != len(accs) {
+				return true, errors.New(fmt.Sprintf("error: %s body must return a list of %d values, one per accumulator", form, len(accs)))
+			}
+			for i, a := range accs {
+				local.set(string(a), vals[i])
+			}
+		}
+		return false, e
+	})
+	if err != nil {
+		return blank_value(), err
+	}
+	switch kind {
+	case "list":
+		return list_from_values(collected), nil
+	case "fold":
+		if len(accs) == 1 {
+			acc, _ := local.get(string(accs[0]))
+			return acc, nil
+		}
+		vals := make([]value, 0)
+		for _, a := range accs {
+			acc, _ := local.get(string(a))
+			vals = append(vals, acc)
+		}
+		return list_from_values(vals), nil
+	}
+	return result, nil
+}
+
+// applyfn calls fn on arguments that have already been evaluated. The
+// arguments are bound to names the parser can never produce, so evaluating
+// them again just hands back the same values.
+func applyfn(fn value, args []value, bindings *env) (value, error) {
+	local := new_env(make(map[string]value), bindings)
+	call := &tree{fn, true, nil, nil}
+	last := call
+	for i, a := range args {
+		name := fmt.Sprintf(" arg%d", i)
+		local.set(name, a)
+		last.next = &tree{value_symbol_init([]rune(name)), true, nil, nil}
+		last = last.next
+	}
+	return eval2(&tree{value_ast_init(call), true, nil, nil}, local)
+}
+
+func sym_is(v value, name string) bool {
+	return is_symbol(v) && len(v.decorations) == 0 && string(v.symbol) == name
+}
+
+/* keywords are the symbols written :name; they evaluate to themselves */
+func is_keyword(v value) bool {
+	return is_symbol(v) && len(v.symbol) > 1 && v.symbol[0] == ':' && !symisstring(v.symbol)
+}
+
+// pattern_vars lists the names a pattern would bind, so that a repeated
+// pattern which matched nothing can still bind each of them to ()
+func pattern_vars(pat value, names []string) []string {
+	if len(pat.decorations) > 0 {
+		return names
+	}
+	if is_symbol(pat) {
+		s := string(pat.symbol)
+		if s == "_" || s == "..." || s == "." || s == "#t" || s == "#f" || len(s) == 0 || symisstring(pat.symbol) || is_integer(pat.symbol) || is_float(pat.symbol) || is_keyword(pat) || is_char_literal(pat.symbol) {
+			return names
+		}
+		return append(names, s)
+	}
+	if pat.valtype == t_tree && pat.ast != nil {
+		p := pat.ast
+		if sym_is(p.val, "quote") {
+			return names
+		}
+		if sym_is(p.val, "?") && p.next != nil {
+			p = p.next.next
+		} else if sym_is(p.val, "list") || sym_is(p.val, "cons") {
+			p = p.next
+		}
+		for ; p != nil; p = p.next {
+			names = pattern_vars(p.val, names)
+		}
+	}
+	return names
+}
+
+func match_list(pats []value, vals []value, binds map[string]value, bindings *env) (bool, error) {
+	for i, p := range pats {
+		if sym_is(p, ".") {
+			if i != len(pats)-2 {
+				return false, errors.New("error: match: . must be followed by exactly one pattern")
+			}
+			if len(vals) < i {
+				return false, nil
+			}
+			if ok, e := match_list(pats[:i], vals[:i], binds, bindings); !ok || e != nil {
+				return ok, e
+			}
+			return match_pattern(pats[i+1], list_from_values(vals[i:]), binds, bindings)
+		}
+		if sym_is(p, "...") {
+			if i == 0 {
+				return false, errors.New("error: match: ... must follow a pattern")
+			}
+			before, rep, after := pats[:i-1], pats[i-1], pats[i+1:]
+			if len(vals) < len(before)+len(after) {
+				return false, nil
+			}
+			if ok, e := match_list(before, vals[:len(before)], binds, bindings); !ok || e != nil {
+				return ok, e
+			}
+			if ok, e := match_list(after, vals[len(vals)-len(after):], binds, bindings); !ok || e != nil {
+				return ok, e
+			}
+			names := pattern_vars(rep, make([]string, 0))
+			collected := make(map[string][]value)
+			for _, v := range vals[len(before) : len(vals)-len(after)] {
+				each := make(map[string]value)
+				if ok, e := match_pattern(rep, v, each, bindings); !ok || e != nil {
+					return ok, e
+				}
+				for _, n := range names {
+					collected[n] = append(collected[n], each[n])
+				}
+			}
+			for _, n := range names {
+				binds[n] = list_from_values(collected[n])
+			}
+			return true, nil
+		}
+	}
+	if len(pats) != len(vals) {
+		return false, nil
+	}
+	for i, p := range pats {
+		if ok, e := match_pattern(p, vals[i], binds, bindings); !ok || e != nil {
+			return ok, e
+		}
+	}
+	return true, nil
+}
+
+func tree_values(t *tree) []value {
+	vals := make([]value, 0)
+	for ; t != nil; t = t.next {
+		vals = append(vals, t.val)
+	}
+	return vals
+}
+
+// same_value compares two values that have already been evaluated, so
+// unlike equalvals it never evaluates list members
+func same_value(v1 value, v2 value, bindings *env) bool {
+	if v1.valtype != v2.valtype {
+		return false
+	}
+	switch v1.valtype {
+	case t_symbol, t_head_symbol:
+		return same_symbol(v1, v2)
+	case t_tree:
+		l1, e1 := list_values(v1)
+		l2, e2 := list_values(v2)
+		if e1 != nil || e2 != nil || len(l1) != len(l2) {
+			return false
+		}
+		for i := range l1 {
+			if !same_value(l1[i], l2[i], bindings) {
+				return false
+			}
+		}
+		return true
+	case t_record:
+		if v1.record().rtype != v2.record().rtype {
+			return false
+		}
+		f1, f2 := v1.record().snapshot(), v2.record().snapshot()
+		for i := range f1 {
+			if !same_value(f1[i], f2[i], bindings) {
+				return false
+			}
+		}
+		return true
+	case t_pmap:
+		if v1.pmap().count != v2.pmap().count {
+			return false
+		}
+		same := true
+		v1.pmap().root.each(func(e pmap_entry) {
+			if v, ok := v2.pmap().get(e.key); !ok || !same_value(e.val, v, bindings) {
+				same = false
+			}
+		})
+		return same
+	case t_pvec:
+		if v1.pvec().count != v2.pvec().count {
+			return false
+		}
+		for i := 0; i < v1.pvec().count; i++ {
+			if !same_value(v1.pvec().nth(i), v2.pvec().nth(i), bindings) {
+				return false
+			}
+		}
+		return true
+	case t_vector:
+		i1, i2 := v1.vector().snapshot(), v2.vector().snapshot()
+		if len(i1) != len(i2) {
+			return false
+		}
+		for i := range i1 {
+			if !same_value(i1[i], i2[i], bindings) {
+				return false
+			}
+		}
+		return true
+	}
+	g, e := equalvals(v1, v2, bindings)
+	return e == nil && g
+}
+
+// match_pattern checks v against the unevaluated pattern pat, adding any
+// variables it binds to binds
+func match_pattern(pat value, v value, binds map[string]value, bindings *env) (bool, error) {
+	if len(pat.decorations) > 0 && pat.decorations[0] == '\'' {
+		q := pat
+		q.decorations = q.decorations[1:]
+		return same_value(quote_value(q), v, bindings), nil
+	}
+	if is_symbol(pat) {
+		s := string(pat.symbol)
+		switch {
+		case s == "_":
+			return true, nil
+		case s == "#t", s == "#f", symisstring(pat.symbol), is_integer(pat.symbol), is_float(pat.symbol), is_keyword(pat), is_char_literal(pat.symbol):
+			return same_value(quote_value(pat), v, bindings), nil
+		}
+		if prev, ok := binds[s]; ok {
+			return same_value(prev, v, bindings), nil
+		}
+		binds[s] = v
+		return true, nil
+	}
+	if pat.valtype != t_tree {
+		return same_value(pat, v, bindings), nil
+	}
+	head := pat.ast
+	if head != nil && sym_is(head.val, "quote") && head.next != nil {
+		return same_value(quote_value(head.next.val), v, bindings), nil
+	}
+	if head != nil && sym_is(head.val, "?") {
+		/* (? predicate pattern ...) */
+		if head.next == nil {
+			return false, errors.New("usage: (? predicate[ pattern ...]) in match")
+		}
+		pred, e := eval2(head.next, bindings)
+		if e != nil {
+			return false, e
+		}
+		r, e1 := applyfn(pred, []value{v}, bindings)
+		if e1 != nil {
+			return false, e1
+		}
+		if t, e2 := istrue(r, bindings); e2 != nil || !t {
+			return false, e2
+		}
+		for p := head.next.next; p != nil; p = p.next {
+			if ok, e3 := match_pattern(p.val, v, binds, bindings); !ok || e3 != nil {
+				return ok, e3
+			}
+		}
+		return true, nil
+	}
+	vals, e := list_values(v)
+	if e != nil {
+		return false, nil
+	}
+	if head != nil && sym_is(head.val, "cons") {
+		/* (cons first rest) */
+		if head.next == nil || head.next.next == nil {
+			return false, errors.New("usage: (cons first-pattern rest-pattern) in match")
+		}
+		if len(vals) == 0 {
+			return false, nil
+		}
+		if ok, e1 := match_pattern(head.next.val, vals[0], binds, bindings); !ok || e1 != nil {
+			return ok, e1
+		}
+		return match_pattern(head.next.next.val, list_from_values(vals[1:]), binds, bindings)
+	}
+	if head != nil && sym_is(head.val, "list") {
+		head = head.next
+	}
+	pats := tree_values(head)
+	if len(pats) == 1 && is_symbol(pats[0]) && len(pats[0].symbol) == 0 {
+		// ()
+		pats = pats[:0]
+	}
+	return match_list(pats, vals, binds, bindings)
+}
+
+// match_clause tries v against a clause (pattern[ #:when guard] body ...).
+// If it matches, it gives back the body and the env that binds the
+// pattern's variables; otherwise body is nil
+func match_clause(c *tree, v value, bindings *env) (*tree, *env, error) {
+	binds := make(map[string]value)
+	ok, e := match_pattern(c.val, v, binds, bindings)
+	if e != nil || !ok {
+		return nil, nil, e
+	}
+	local := new_env(binds, bindings)
+	body := c.next
+	if sym_is(body.val, "#:when") {
+		if body.next == nil || body.next.next == nil {
+			return nil, nil, errors.New("error: match clause must look like (pattern #:when guard body ...)")
+		}
+		g, e1 := eval2(body.next, local)
+		if e1 != nil {
+			return nil, nil, e1
+		}
+		if t, e2 := istrue(g, local); e2 != nil || !t {
+			return nil, nil, e2
+		}
+		body = body.next.next
+	}
+	return body, local, nil
+}
+
+func matchfunc(ast *tree, bindings *env) (value, error) {
+	/* (match expr (pattern[ #:when guard] body ...) ...) */
+	if ast.next == nil || ast.next.next == nil {
+		return blank_value(), errors.New("usage: (match value (pattern[ #:when guard] body ...) ...)")
+	}
+	v, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	for c := ast.next.next; c != nil; c = c.next {
+		if c.val.valtype != t_tree || c.val.ast == nil || c.val.ast.next == nil {
+			return blank_value(), errors.New("error: match clause must look like (pattern body ...)")
+		}
+		body, local, e1 := match_clause(c.val.ast, v, bindings)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if body != nil {
+			return prognfunc(body, local)
+		}
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: match: no clause matches %s", value_string(v)))
+}
+
+func error_text(e *error_value) string {
+	msg := "error: " + e.message
+	if strings.HasPrefix(e.message, "usage: ") {
+		msg = e.message
+	} else if string(e.kind) != "error" && string(e.kind) != "runtime" {
+		msg = fmt.Sprintf("error (%s): %s", string(e.kind), e.message)
+	}
+	for _, i := range e.irritants {
+		msg += " " + value_string(i)
+	}
+	return msg
+}
+
+// error_object gives the value a catch clause binds for err: whatever was
+// raised, or for a failure the error object describing it, which picks up
+// where it happened on the way
+func error_object(err error) value {
+	re := as_radu_error(err)
+	if re.obj.valtype == t_error && re.obj.err().form == nil {
+		re.obj.err().form = re.form
+		re.obj.err().trace = re.trace
+	}
+	return re.obj
+}
+
+// make_condition builds a condition from the arguments to error, signal,
+// warn and make-condition: either a condition object, or an optional kind
+// followed by a message and irritants
+func make_condition(ast *tree, bindings *env, form string, kind []rune) (value, error) {
+	usage := errors.New(fmt.Sprintf("usage: (%s[ kind] \"message\"[ irritant ...])", form))
+	if ast.next == nil {
+		return blank_value(), usage
+	}
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if args[0].valtype == t_error {
+		return args[0], nil
+	}
+	if !is_string(args[0]) && is_symbol(args[0]) {
+		kind = args[0].symbol
+		args = args[1:]
+	}
+	if len(args) == 0 || !is_string(args[0]) {
+		return blank_value(), usage
+	}
+	return value_error_init(kind, string(stringify(args[0].symbol)), args[1:]), nil
+}
+
+func errorfunc(ast *tree, bindings *env) (value, error) {
+	/* (error[ kind] "message" irritant ...) */
+	c, e := make_condition(ast, bindings, "error", []rune("error"))
+	if e != nil {
+		return blank_value(), e
+	}
+	return blank_value(), signal_error(c, bindings)
+}
+
+func raisefunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (raise value)")
+	}
+	v, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	return blank_value(), &radu_error{v, nil, make([]frame, 0), false}
+}
+
+func errorobjfunc(ast *tree, bindings *env, which string) (value, error) {
+	if ast.next == nil {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s error-object)", which))
+	}
+	v, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if which == "error-object?" {
+		if v.valtype == t_error {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	if v.valtype != t_error {
+		return blank_value(), errors.New(fmt.Sprintf("error: %s expects an error object, given %s", which, typenames[v.valtype]))
+	}
+	switch which {
+	case "error-object-message":
+		return string_value(v.err().message), nil
+	case "error-object-kind":
+		return value_symbol_init(v.err().kind), nil
+	case "error-object-location":
+		if v.err().form == nil {
+			return falsesym(), nil
+		}
+		p := v.err().form.val.pos
+		return list_from_values([]value{string_value(p.file), value_number_int_init(int64(p.line)), value_number_int_init(int64(p.col))}), nil
+	case "error-object-trace":
+		frames := make([]value, 0)
+		for _, f := range v.err().trace {
+			frames = append(frames, list_from_values([]value{value_symbol_init([]rune(f.name)), string_value(f.pos.file), value_number_int_init(int64(f.pos.line)), value_number_int_init(int64(f.pos.col))}))
+		}
+		return list_from_values(frames), nil
+	}
+	return list_from_values(v.err().irritants), nil
+}
+
+func tryfunc(ast *tree, bindings *env, form string) (value, error) {
+	/* (try body ... (catch (e) handler ...) (finally cleanup ...))
+	(unwind-protect body cleanup ...) */
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (try body ...[ (catch (var) handler ...)][ (finally cleanup ...)])")
+	}
+	var catch, finally *tree
+	body := make([]*tree, 0)
+	if form == "unwind-protect" {
+		body = append(body, ast.next)
+		finally = ast.next.next
+	} else {
+		for c := ast.next; c != nil; c = c.next {
+			if c.val.valtype == t_tree && c.val.ast != nil && len(c.val.decorations) == 0 {
+				if sym_is(c.val.ast.val, "catch") {
+					catch = c.val.ast
+					continue
+				}
+				if sym_is(c.val.ast.val, "finally") {
+					finally = c.val.ast.next
+					continue
+				}
+			}
+			if catch != nil || finally != nil {
+				return blank_value(), errors.New("error: catch and finally must come after the body of try")
+			}
+			body = append(body, c)
+		}
+	}
+	r := blank_value()
+	var err error
+	for _, b := range body {
+		if r, err = eval2(b, bindings); err != nil {
+			break
+		}
+	}
+	if err != nil && catch != nil && !is_control(err) {
+		spec := catch.next
+		if spec == nil || spec.val.valtype != t_tree || spec.val.ast == nil || !is_symbol(spec.val.ast.val) || spec.next == nil {
+			return blank_value(), errors.New("usage: (catch (var) handler ...)")
+		}
+		local := new_env(make(map[string]value), bindings)
+		local.set(string(spec.val.ast.val.symbol), error_object(err))
+		r, err = prognfunc(spec.next, local)
+	}
+	if finally != nil {
+		if _, e := prognfunc(finally, bindings); e != nil {
+			return blank_value(), e
+		}
+	}
+	return r, err
+}
+
+// condition kinds form a hierarchy; a handler for a kind also handles
+// all of the kinds below it. Kinds nobody has declared count as errors.
+var condition_parents = map[string]string{
+	"condition":            "",
+	"serious-condition":    "condition",
+	"warning":              "condition",
+	"error":                "serious-condition",
+	"runtime":              "error",
+	"simple-error":         "error",
+	"type-error":           "error",
+	"parse-error":          "error",
+	"control-error":        "error",
+	"unbound-variable":     "error",
+	"arithmetic-error":     "error",
+	"division-by-zero":     "arithmetic-error",
+	"channel-error":        "error",
+	"transaction-error":    "error",
+	"key-error":            "error",
+	"range-error":          "error",
+	"unbound-slot":         "error",
+	"no-applicable-method": "error",
+	"regexp-error":         "error",
+}
+
+/* tasks may declare kinds while others are signalling them */
+var condition_mu sync.RWMutex
+
+func condition_isa(kind string, ancestor string) bool {
+	condition_mu.RLock()
+	defer condition_mu.RUnlock()
+	for {
+		if kind == ancestor {
+			return true
+		}
+		parent, ok := condition_parents[kind]
+		if !ok {
+			parent = "error"
+		}
+		if parent == "" {
+			return false
+		}
+		kind = parent
+	}
+}
+
+// restart_jump unwinds from invoke-restart to the restart-case that
+// established the restart
+type restart_jump struct {
+	frame int64
+	name  string
+	args  []value
+}
+
+func (r *restart_jump) Error() string {
+	return fmt.Sprintf("error: restart %s invoked outside its restart-case", r.name)
+}
+
+// handler_exit unwinds from a handler-case's handler to the handler-case,
+// which runs the clause with the condition
+type handler_exit struct {
+	frame  int64
+	clause *tree
+	c      value
+}
+
+func (h *handler_exit) Error() string {
+	return "error: handler-case clause invoked outside its handler-case"
+}
+
+// is_control reports whether err is a transfer of control rather than a
+// failure, which try and handler-case must let past
+func is_control(err error) bool {
+	switch err.(type) {
+	case *restart_jump, *handler_exit, *escape, *txn_retry:
+		return true
+	}
+	return false
+}
+
+var frame_ids int64
+
+func next_frame_id() int64 {
+	return atomic.AddInt64(&frame_ids, 1)
+}
+
+// handler-bind and restart-case keep their handlers and restarts in the
+// environment under names the parser can't produce. Environments chain
+// along the dynamic extent of the program, so walking up from wherever a
+// condition is signalled finds exactly the ones that are active there.
+const handlers_key = " handlers"
+const restarts_key = " restarts"
+const barrier_key = " handler-barrier"
+
+// a spawned task runs in an env marked with task_key. Handlers and
+// restarts outside it belong to another goroutine's stack, so the walks
+// stop there.
+const task_key = " task"
+
+func in_task(bindings *env) bool {
+	for b := bindings; b != nil; b = b.prev {
+		if _, ok := b.get(task_key); ok {
+			return true
+		}
+	}
+	return false
+}
+
+type active_handler struct {
+	kind  string
+	fn    value
+	frame int64
+}
+
+func active_handlers(bindings *env) []active_handler {
+	hs := make([]active_handler, 0)
+	skip := int64(0)
+	for b := bindings; b != nil; b = b.prev {
+		if _, ok := b.get(task_key); ok {
+			break
+		}
+		if bar, ok := b.get(barrier_key); ok && skip == 0 {
+			skip = bar.number.intval
+		}
+		h, ok := b.get(handlers_key)
+		if !ok {
+			continue
+		}
+		entries, _ := list_values(h)
+		id := entries[0].number.intval
+		if skip != 0 {
+			if id == skip {
+				skip = 0
+			}
+			continue
+		}
+		for _, e := range entries[1:] {
+			pair, _ := list_values(e)
+			hs = append(hs, active_handler{string(pair[0].symbol), pair[1], id})
+		}
+	}
+	return hs
+}
+
+type active_restart struct {
+	name   string
+	frame  int64
+	params int
+}
+
+func active_restarts(bindings *env) []active_restart {
+	rs := make([]active_restart, 0)
+	for b := bindings; b != nil; b = b.prev {
+		if _, ok := b.get(task_key); ok {
+			break
+		}
+		r, ok := b.get(restarts_key)
+		if !ok {
+			continue
+		}
+		entries, _ := list_values(r)
+		for _, e := range entries[1:] {
+			pair, _ := list_values(e)
+			rs = append(rs, active_restart{string(pair[0].symbol), entries[0].number.intval, int(pair[1].number.intval)})
+		}
+	}
+	return rs
+}
+
+// signal runs the applicable handlers, innermost first, at the point the
+// condition happened. A handler declines by returning normally; it handles
+// the condition by transferring control, usually with invoke-restart, and
+// that transfer is what signal returns.
+func signal(c value, bindings *env) error {
+	if c.valtype != t_error {
+		return nil
+	}
+	for _, h := range active_handlers(bindings) {
+		if !condition_isa(string(c.err().kind), h.kind) {
+			continue
+		}
+		/* while a handler runs, only the handlers outside its own
+		handler-bind are active */
+		local := new_env(make(map[string]value), bindings)
+		local.set(barrier_key, value_number_int_init(h.frame))
+		if _, e := applyfn(h.fn, []value{c}, local); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+// signal_error signals c as an error: if no handler takes control, the
+// repl's debugger is offered the restarts, and failing that c is raised
+func signal_error(c value, bindings *env) error {
+	if e := signal(c, bindings); e != nil {
+		return e
+	}
+	if interactive && !in_task(bindings) {
+		if e := restart_debugger(c, bindings); e != nil {
+			return e
+		}
+	}
+	return &radu_error{c, nil, make([]frame, 0), true}
+}
+
+func restart_debugger(c value, bindings *env) error {
+	rs := active_restarts(bindings)
+	if len(rs) == 0 {
+		return nil
+	}
+	fmt.Println(error_text(c.err()))
+	fmt.Println("available restarts:")
+	for i, r := range rs {
+		fmt.Printf("  %d: %s\n", i, r.name)
+	}
+	fmt.Printf("  %d: return to the top level\n", len(rs))
+	for {
+		fmt.Printf("restart> ")
+		text, rerr := stdin.ReadString('\n')
+		if rerr != nil {
+			return nil
+		}
+		n, cerr := strconv.Atoi(strings.TrimSpace(text))
+		if cerr != nil || n < 0 || n > len(rs) {
+			fmt.Printf("choose a number from 0 to %d\n", len(rs))
+			continue
+		}
+		if n == len(rs) {
+			return nil
+		}
+		args := make([]value, 0)
+		for i := 0; i < rs[n].params; i++ {
+			fmt.Printf("value %d for %s> ", i+1, rs[n].name)
+			text, rerr = stdin.ReadString('\n')
+			if rerr != nil {
+				return nil
+			}
+			arg, e := read_program([]rune(strings.TrimSuffix(text, "\n")), "<stdin>", 1)
+			if e != nil {
+				return e
+			}
+			v, e := prognfunc(arg, bindings)
+			if e != nil {
+				return e
+			}
+			args = append(args, v)
+		}
+		return &restart_jump{rs[n].frame, rs[n].name, args}
+	}
+}
+
+// signal_failure signals err at bindings if it is a builtin's failure
+// that nobody has signalled yet, and marks it so that nobody further out
+// signals it a second time. It gives back what to carry on with: the
+// transfer of control a handler or the restart prompt chose, or err
+func signal_failure(err error, bindings *env) error {
+	if err == nil || is_control(err) {
+		return err
+	}
+	re := as_radu_error(err)
+	if re.signalled || re.obj.valtype != t_error {
+		return err
+	}
+	re.signalled = true
+	if e := signal(re.obj, bindings); e != nil {
+		return e
+	}
+	if interactive && !in_task(bindings) {
+		if e := restart_debugger(re.obj, bindings); e != nil {
+			return e
+		}
+	}
+	return re
+}
+
+func signalfunc(ast *tree, bindings *env, form string) (value, error) {
+	/* (signal[ kind] "message" irritant ...), (warn ...) */
+	kind := []rune("condition")
+	if form == "warn" {
+		kind = []rune("warning")
+	}
+	c, e := make_condition(ast, bindings, form, kind)
+	if e != nil {
+		return blank_value(), e
+	}
+	if form == "make-condition" {
+		return c, nil
+	}
+	if e1 := signal(c, bindings); e1 != nil {
+		return blank_value(), e1
+	}
+	if form == "warn" {
+		msg := "warning: " + c.err().message
+		for _, i := range c.err().irritants {
+			msg += " " + value_string(i)
+		}
+		fmt.Println(msg)
+	}
+	return falsesym(), nil
+}
+
+func handlerbindfunc(ast *tree, bindings *env) (value, error) {
+	/* (handler-bind ((kind handler) ...) body ...) */
+	usage := errors.New("usage: (handler-bind ((kind handler) ...) body[ body ...])")
+	if ast.next == nil || ast.next.next == nil || ast.next.val.valtype != t_tree {
+		return blank_value(), usage
+	}
+	entries := []value{value_number_int_init(next_frame_id())}
+	for h := ast.next.val.ast; h != nil; h = h.next {
+		if h.val.valtype != t_tree || h.val.ast == nil || !is_symbol(h.val.ast.val) || h.val.ast.next == nil {
+			return blank_value(), usage
+		}
+		fn, e := eval2(h.val.ast.next, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		entries = append(entries, list_from_values([]value{value_symbol_init(h.val.ast.val.symbol), fn}))
+	}
+	local := new_env(make(map[string]value), bindings)
+	local.set(handlers_key, list_from_values(entries))
+	r, err := prognfunc(ast.next.next, local)
+	/* a builtin's failure hasn't been signalled yet; it is here, so our
+	handlers see it as well as those outside */
+	return r, signal_failure(err, local)
+}
+
+func handlercasefunc(ast *tree, bindings *env) (value, error) {
+	/* (handler-case expr (kind (var) body ...) ...) */
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (handler-case expr (kind (var) body ...) ...)")
+	}
+	/* each clause is a handler, as in handler-bind, that unwinds back
+	here instead of returning, so conditions from signal and warn reach
+	the clauses as well as errors */
+	id := next_frame_id()
+	entries := []value{value_number_int_init(id)}
+	for h := ast.next.next; h != nil; h = h.next {
+		if h.val.valtype != t_tree || h.val.ast == nil || !is_symbol(h.val.ast.val) || h.val.ast.next == nil || h.val.ast.next.val.valtype != t_tree {
+			return blank_value(), errors.New("error: handler-case clause must look like (kind (var) body ...)")
+		}
+		clause := h.val.ast
+		exit := value_primitive_init("handler-case", func(args []value, b *env) (value, error) {
+			return blank_value(), &handler_exit{id, clause, args[0]}
+		})
+		entries = append(entries, list_from_values([]value{value_symbol_init(clause.val.symbol), exit}))
+	}
+	local := new_env(make(map[string]value), bindings)
+	local.set(handlers_key, list_from_values(entries))
+	r, err := eval2(ast.next, local)
+	if h, ok := err.(*handler_exit); ok && h.frame == id {
+		return handler_clause(h.clause, h.c, bindings)
+	}
+	if err == nil || is_control(err) {
+		return r, err
+	}
+	/* errors that were never signalled, like a builtin failing, or that
+	were signalled where these handlers couldn't be seen, as in a task
+	that was joined */
+	c := error_object(err)
+	kind := "error"
+	if c.valtype == t_error {
+		kind = string(c.err().kind)
+	}
+	for h := ast.next.next; h != nil; h = h.next {
+		if condition_isa(kind, string(h.val.ast.val.symbol)) {
+			return handler_clause(h.val.ast, c, bindings)
+		}
+	}
+	return r, err
+}
+
+// handler_clause runs the handler-case clause (kind (var) body ...) with
+// var bound to the condition c
+func handler_clause(clause *tree, c value, bindings *env) (value, error) {
+	local := new_env(make(map[string]value), bindings)
+	if spec := clause.next.val.ast; spec != nil && is_symbol(spec.val) && len(spec.val.symbol) > 0 {
+		local.set(string(spec.val.symbol), c)
+	}
+	if clause.next.next == nil {
+		return blank_value(), nil
+	}
+	return prognfunc(clause.next.next, local)
+}
+
+func restartcasefunc(ast *tree, bindings *env) (value, error) {
+	/* (restart-case expr (name (param ...) body ...) ...) */
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (restart-case expr (name (param ...) body ...) ...)")
+	}
+	id := next_frame_id()
+	entries := []value{value_number_int_init(id)}
+	clauses := make(map[string]*tree)
+	for c := ast.next.next; c != nil; c = c.next {
+		if c.val.valtype != t_tree || c.val.ast == nil || !is_symbol(c.val.ast.val) || c.val.ast.next == nil || c.val.ast.next.val.valtype != t_tree {
+			return blank_value(), errors.New("error: restart-case clause must look like (name (param ...) body ...)")
+		}
+		params := tree_values(c.val.ast.next.val.ast)
+		if len(params) == 1 && len(params[0].symbol) == 0 {
+			params = params[:0]
+		}
+		name := string(c.val.ast.val.symbol)
+		entries = append(entries, list_from_values([]value{value_symbol_init(c.val.ast.val.symbol), value_number_int_init(int64(len(params)))}))
+		clauses[name] = c.val.ast.next
+	}
+	local := new_env(make(map[string]value), bindings)
+	local.set(restarts_key, list_from_values(entries))
+	r, err := eval2(ast.next, local)
+	/* if a builtin failed, signal it here, where our restarts are still
+	available */
+	err = signal_failure(err, local)
+	jump, ok := err.(*restart_jump)
+	if !ok || jump.frame != id {
+		return r, err
+	}
+	clause := clauses[jump.name]
+	params := tree_values(clause.val.ast)
+	if len(params) == 1 && len(params[0].symbol) == 0 {
+		params = params[:0]
+	}
+	if len(params) != len(jump.args) {
+		return blank_value(), errors.New(fmt.Sprintf("error: restart %s takes %d arguments, given %d", jump.name, len(params), len(jump.args)))
+	}
+	rb := new_env(make(map[string]value), bindings)
+	for i, p := range params {
+		rb.set(string(p.symbol), jump.args[i])
+	}
+	if clause.next == nil {
+		return blank_value(), nil
+	}
+	return prognfunc(clause.next, rb)
+}
+
+func invokerestartfunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (invoke-restart 'name[ arg ...])")
+	}
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if !is_symbol(args[0]) {
+		return blank_value(), errors.New(fmt.Sprintf("error: invoke-restart expects a restart name, given %s", typenames[args[0].valtype]))
+	}
+	for _, r := range active_restarts(bindings) {
+		if r.name == string(args[0].symbol) {
+			return blank_value(), &restart_jump{r.frame, r.name, args[1:]}
+		}
+	}
+	return blank_value(), signal_error(value_error_init([]rune("control-error"), "no active restart named "+string(args[0].symbol), make([]value, 0)), bindings)
+}
+
+func restartqueryfunc(ast *tree, bindings *env, form string) (value, error) {
+	rs := active_restarts(bindings)
+	if form == "find-restart" {
+		if ast.next == nil {
+			return blank_value(), errors.New("usage: (find-restart 'name)")
+		}
+		n, e := eval2(ast.next, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		for _, r := range rs {
+			if is_symbol(n) && r.name == string(n.symbol) {
+				return n, nil
+			}
+		}
+		return falsesym(), nil
+	}
+	names := make([]value, 0)
+	for _, r := range rs {
+		names = append(names, value_symbol_init([]rune(r.name)))
+	}
+	return list_from_values(names), nil
+}
+
+func conditiontypefunc(ast *tree, bindings *env, form string) (value, error) {
+	if ast.next == nil || ast.next.next == nil {
+		if form == "define-condition-type" {
+			return blank_value(), errors.New("usage: (define-condition-type 'name 'parent)")
+		}
+		return blank_value(), errors.New("usage: (condition-is-a? condition 'kind)")
+	}
+	a, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	b, e1 := eval2(ast.next.next, bindings)
+	if e1 != nil {
+		return blank_value(), e1
+	}
+	if !is_symbol(b) {
+		return blank_value(), errors.New(fmt.Sprintf("error: %s expects a kind, given %s", form, typenames[b.valtype]))
+	}
+	if form == "define-condition-type" {
+		if !is_symbol(a) {
+			return blank_value(), errors.New(fmt.Sprintf("error: define-condition-type expects a kind, given %s", typenames[a.valtype]))
+		}
+		if condition_isa(string(b.symbol), string(a.symbol)) {
+			return blank_value(), errors.New(fmt.Sprintf("error: %s can't be its own ancestor", string(a.symbol)))
+		}
+		condition_mu.Lock()
+		condition_parents[string(a.symbol)] = string(b.symbol)
+		condition_mu.Unlock()
+		return a, nil
+	}
+	if a.valtype == t_error && condition_isa(string(a.err().kind), string(b.symbol)) {
+		return truesym(), nil
+	}
+	return falsesym(), nil
+}
+
+// escape unwinds from a call to a continuation back to the call/ec that
+// made it, carrying the value to return from there
+type escape struct {
+	id  int64
+	val value
+}
+
+func (e *escape) Error() string {
+	return "error: continuation invoked outside of its extent"
+}
+
+// with_escape calls body with a continuation that returns from
+// with_escape. Continuations only escape: once with_escape has returned,
+// calling one is an error.
+func with_escape(bindings *env, body func(k value) (value, error)) (value, error) {
+	id := next_frame_id()
+	var live int32 = 1
+	k := value_primitive_init("continuation", func(args []value, b *env) (value, error) {
+		if atomic.LoadInt32(&live) == 0 {
+			return blank_value(), new_error("control-error", "continuation invoked outside of its extent")
+		}
+		if len(args) > 1 {
+			return blank_value(), errors.New(fmt.Sprintf("error: continuation takes at most one value, given %d", len(args)))
+		}
+		r := blank_value()
+		if len(args) == 1 {
+			r = args[0]
+		}
+		return blank_value(), &escape{id, r}
+	})
+	v, err := body(k)
+	atomic.StoreInt32(&live, 0)
+	if esc, ok := err.(*escape); ok && esc.id == id {
+		return esc.val, nil
+	}
+	return v, err
+}
+
+func callecfunc(ast *tree, bindings *env, form string) (value, error) {
+	/* (call/ec (lambda (k) ...)), (let/ec k body ...) */
+	if form == "let/ec" {
+		if ast.next == nil || !is_symbol(ast.next.val) || ast.next.next == nil {
+			return blank_value(), errors.New("usage: (let/ec k body[ body ...])")
+		}
+		return with_escape(bindings, func(k value) (value, error) {
+			local := new_env(make(map[string]value), bindings)
+			local.set(string(ast.next.val.symbol), k)
+			return prognfunc(ast.next.next, local)
+		})
+	}
+	if ast.next == nil {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s (lambda (k) body))", form))
+	}
+	fn, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	return with_escape(bindings, func(k value) (value, error) {
+		return applyfn(fn, []value{k}, bindings)
+	})
+}
+
+// a task is a procedure running on its own goroutine. done is closed once
+// result and err are set, so join can read them without a lock
+type task struct {
+	done   chan struct{}
+	result value
+	err    error
+}
+
+type channel struct {
+	ch chan value
+}
+
+func spawnfunc(ast *tree, bindings *env) (value, error) {
+	/* (spawn (lambda () body ...)) */
+	if ast.next == nil || ast.next.next != nil {
+		return blank_value(), errors.New("usage: (spawn thunk)")
+	}
+	fn, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if fn.valtype != t_function && fn.valtype != t_primitive {
+		return blank_value(), new_error("type-error", "spawn expects a procedure, given %s", typenames[fn.valtype])
+	}
+	t := &task{make(chan struct{}), blank_value(), nil}
+	local := new_env(make(map[string]value), bindings)
+	local.set(task_key, truesym())
+	go func() {
+		defer close(t.done)
+		t.result, t.err = applyfn(fn, make([]value, 0), local)
+	}()
+	return value_task_init(t), nil
+}
+
+func joinfunc(ast *tree, bindings *env) (value, error) {
+	/* (join task) waits for the task, or actor, and gives back its result,
+	or raises its error again here */
+	if ast.next == nil || ast.next.next != nil {
+		return blank_value(), errors.New("usage: (join task)")
+	}
+	v, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	t := v.task()
+	if v.valtype == t_pid {
+		t = v.actor().task
+	} else if v.valtype != t_task {
+		return blank_value(), new_error("type-error", "join expects a task or a pid, given %s", typenames[v.valtype])
+	}
+	<-t.done
+	if t.err != nil {
+		return blank_value(), task_error(t.err)
+	}
+	return t.result, nil
+}
+
+// task_error raises an error from another goroutine again here. Each
+// caller gets its own copy, so the handlers here see it afresh and the
+// trace can grow without racing anyone else reading it
+func task_error(err error) error {
+	if is_control(err) {
+		return err
+	}
+	re := as_radu_error(err)
+	return &radu_error{re.obj, re.form, append(make([]frame, 0), re.trace...), false}
+}
+
+// parallel_map calls fn on every item using at most workers goroutines.
+// Results keep the order of items. Once a call fails no more are started,
+// and the error of the earliest item that failed is returned.
+func parallel_map(fn value, items []value, workers int, bindings *env) ([]value, error) {
+	results := make([]value, len(items))
+	errs := make([]error, len(items))
+	local := new_env(make(map[string]value), bindings)
+	local.set(task_key, truesym())
+	next := int64(-1)
+	var failed int32
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(items); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= len(items) {
+					return
+				}
+				results[i], errs[i] = applyfn(fn, []value{items[i]}, local)
+				if errs[i] != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, e := range errs {
+		if e != nil {
+			return nil, task_error(e)
+		}
+	}
+	return results, nil
+}
+
+func pmapfunc(ast *tree, bindings *env, form string) (value, error) {
+	/* (pmap f list [workers]), (pfor-each f list [workers]) */
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if len(args) != 2 && len(args) != 3 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s function list [workers])", form))
+	}
+	if args[0].valtype != t_function && args[0].valtype != t_primitive {
+		return blank_value(), new_error("type-error", "%s expects a procedure, given %s", form, typenames[args[0].valtype])
+	}
+	items, e1 := sequence_values(args[1])
+	if e1 != nil {
+		return blank_value(), e1
+	}
+	workers := runtime.NumCPU()
+	if len(args) == 3 {
+		if args[2].valtype != t_number_int || args[2].number.intval < 1 {
+			return blank_value(), new_error("type-error", "%s expects at least 1 worker, given %s", form, value_string(args[2]))
+		}
+		workers = int(args[2].number.intval)
+	}
+	results, e2 := parallel_map(args[0], items, workers, bindings)
+	if e2 != nil {
+		return blank_value(), e2
+	}
+	if form == "pfor-each" {
+		return blank_value(), nil
+	}
+	return list_from_values(results), nil
+}
+
+func channel_arg(v value, form string) (*channel, error) {
+	if v.valtype != t_channel {
+		return nil, new_error("type-error", "%s expects a channel, given %s", form, typenames[v.valtype])
+	}
+	return v.channel(), nil
+}
+
+func channelfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "make-channel":
+		/* (make-channel) is unbuffered, (make-channel n) holds n values */
+		if len(args) > 1 {
+			return blank_value(), errors.New("usage: (make-channel [buffer-size])")
+		}
+		size := int64(0)
+		if len(args) == 1 {
+			if args[0].valtype != t_number_int || args[0].number.intval < 0 {
+				return blank_value(), new_error("type-error", "make-channel expects a buffer size of 0 or more, given %s", value_string(args[0]))
+			}
+			size = args[0].number.intval
+		}
+		return value_channel_init(&channel{make(chan value, size)}), nil
+	case "send":
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (send channel value)")
+		}
+		c, e1 := channel_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if e2 := channel_send(c, args[1]); e2 != nil {
+			return blank_value(), e2
+		}
+		return args[1], nil
+	case "receive":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (receive channel)")
+		}
+		c, e1 := channel_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if v, ok := <-c.ch; ok {
+			return v, nil
+		}
+		return eof_value(), nil
+	case "close":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (close channel)")
+		}
+		c, e1 := channel_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if e2 := channel_close(c); e2 != nil {
+			return blank_value(), e2
+		}
+		return blank_value(), nil
+	case "eof-object?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (eof-object? value)")
+		}
+		if args[0].valtype == t_eof {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown channel operation %s", form))
+}
+
+/* Go panics on sending to or closing a closed channel; radu raises */
+func channel_send(c *channel, v value) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = new_error("channel-error", "send on a closed channel")
+		}
+	}()
+	c.ch <- v
+	return nil
+}
+
+func channel_close(c *channel) (err error) {
+	defer func() {
+		if recover() != nil {
+			err = new_error("channel-error", "close of a closed channel")
+		}
+	}()
+	close(c.ch)
+	return nil
+}
+
+func selectfunc(ast *tree, bindings *env) (value, error) {
+	/* (select ((receive ch v) body ...)
+	           ((send ch expr) body ...)
+	           ((timeout ms) body ...)
+	           (else body ...))
+	waits for the first clause that can go ahead and runs its body. every
+	channel and value is evaluated up front, in order. */
+	usage := errors.New("usage: (select ((receive channel [var]) body ...) ((send channel value) body ...) ((timeout ms) body ...) (else body ...))")
+	if ast.next == nil {
+		return blank_value(), usage
+	}
+	cases := make([]reflect.SelectCase, 0)
+	clauses := make([]*tree, 0)
+	for c := ast.next; c != nil; c = c.next {
+		if c.val.valtype != t_tree || c.val.ast == nil {
+			return blank_value(), usage
+		}
+		head := c.val.ast.val
+		if sym_is(head, "else") {
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectDefault})
+			clauses = append(clauses, c.val.ast)
+			continue
+		}
+		if head.valtype != t_tree || head.ast == nil || head.ast.next == nil {
+			return blank_value(), usage
+		}
+		v, e := eval2(head.ast.next, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		switch op := head.ast.val; {
+		case sym_is(op, "receive"):
+			ch, e1 := channel_arg(v, "select")
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(ch.ch)})
+		case sym_is(op, "send"):
+			ch, e1 := channel_arg(v, "select")
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			if head.ast.next.next == nil {
+				return blank_value(), usage
+			}
+			out, e2 := eval2(head.ast.next.next, bindings)
+			if e2 != nil {
+				return blank_value(), e2
+			}
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectSend, Chan: reflect.ValueOf(ch.ch), Send: reflect.ValueOf(out)})
+		case sym_is(op, "timeout"):
+			if v.valtype != t_number_int && v.valtype != t_number_float {
+				return blank_value(), new_error("type-error", "select timeout expects milliseconds, given %s", typenames[v.valtype])
+			}
+			after := time.After(time.Duration(num2float(v) * float64(time.Millisecond)))
+			cases = append(cases, reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(after)})
+		default:
+			return blank_value(), usage
+		}
+		clauses = append(clauses, c.val.ast)
+	}
+	i, got, ok, e := select_cases(cases)
+	if e != nil {
+		return blank_value(), e
+	}
+	clause := clauses[i]
+	local := new_env(make(map[string]value), bindings)
+	result := blank_value()
+	if cases[i].Dir == reflect.SelectSend {
+		result = cases[i].Send.Interface().(value)
+	} else if cases[i].Dir == reflect.SelectRecv && sym_is(clause.val.ast.val, "receive") {
+		result = eof_value()
+		if ok {
+			result = got.Interface().(value)
+		}
+		if v := clause.val.ast.next.next; v != nil {
+			if !is_symbol(v.val) {
+				return blank_value(), usage
+			}
+			local.set(string(v.val.symbol), result)
+		}
+	}
+	/* a clause with no body gives back what it received or sent */
+	if clause.next == nil {
+		return result, nil
+	}
+	return prognfunc(clause.next, local)
+}
+
+func select_cases(cases []reflect.SelectCase) (i int, got reflect.Value, ok bool, err error) {
+	defer func() {
+		if recover() != nil {
+			err = new_error("channel-error", "send on a closed channel")
+		}
+	}()
+	i, got, ok = reflect.Select(cases)
+	return i, got, ok, nil
+}
+
+// an atom holds one value that any task can swap. version goes up on
+// every change, so swap! can tell whether someone got in first
+type atom struct {
+	mu      sync.Mutex
+	val     value
+	version int64
+}
+
+// a ref is only changed inside dosync. refs are committed in order of
+// id, so two transactions never wait on each other's locks
+type ref struct {
+	mu      sync.Mutex
+	id      int64
+	val     value
+	version int64
+}
+
+func (a *atom) load() (value, int64) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.val, a.version
+}
+
+func (r *ref) load() (value, int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.val, r.version
+}
+
+func atomfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if form == "atom" {
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (atom value)")
+		}
+		return value_atom_init(&atom{val: args[0]}), nil
+	}
+	if len(args) == 0 || args[0].valtype != t_atom {
+		if len(args) == 0 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s atom ...)", form))
+		}
+		return blank_value(), new_error("type-error", "%s expects an atom, given %s", form, typenames[args[0].valtype])
+	}
+	a := args[0].atom()
+	switch form {
+	case "reset!":
+		/* (reset! a v) */
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (reset! atom value)")
+		}
+		a.mu.Lock()
+		a.val = args[1]
+		a.version++
+		a.mu.Unlock()
+		return args[1], nil
+	case "swap!":
+		/* (swap! a f extra ...) sets a to (f old extra ...). f may run more
+		than once if other tasks change a meanwhile, so it should have no
+		side effects */
+		if len(args) < 2 {
+			return blank_value(), errors.New("usage: (swap! atom function[ arg ...])")
+		}
+		for {
+			old, version := a.load()
+			nv, e1 := applyfn(args[1], append([]value{old}, args[2:]...), bindings)
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			a.mu.Lock()
+			if a.version == version {
+				a.val = nv
+				a.version++
+				a.mu.Unlock()
+				return nv, nil
+			}
+			a.mu.Unlock()
+		}
+	case "compare-and-set!":
+		/* (compare-and-set! a old new) sets a to new only if it is equal? to old */
+		if len(args) != 3 {
+			return blank_value(), errors.New("usage: (compare-and-set! atom old new)")
+		}
+		a.mu.Lock()
+		defer a.mu.Unlock()
+		if !same_value(a.val, args[1], bindings) {
+			return falsesym(), nil
+		}
+		a.val = args[2]
+		a.version++
+		return truesym(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown atom operation %s", form))
+}
+
+// a transaction remembers the version of every ref it has read and the
+// value of every ref it means to write. The env only holds its id, under
+// txn_key, and transactions finds it from there
+type transaction struct {
+	reads  map[*ref]int64
+	writes map[*ref]value
+}
+
+const txn_key = " transaction"
+
+var transactions sync.Map
+
+// thrown when a transaction has seen a ref change under it; dosync
+// catches it and runs the body again
+type txn_retry struct {
+	id int64
+}
+
+func (e *txn_retry) Error() string {
+	return "error: transaction retried outside of its dosync"
+}
+
+func current_txn(bindings *env) (*transaction, int64) {
+	for b := bindings; b != nil; b = b.prev {
+		if _, ok := b.get(task_key); ok {
+			break
+		}
+		if id, ok := b.get(txn_key); ok {
+			if t, ok := transactions.Load(id.number.intval); ok {
+				return t.(*transaction), id.number.intval
+			}
+		}
+	}
+	return nil, 0
+}
+
+/* valid checks nothing the transaction read has been committed to since */
+func (t *transaction) valid() bool {
+	for r, version := range t.reads {
+		if _, v := r.load(); v != version {
+			return false
+		}
+	}
+	return true
+}
+
+// read gives the value of r as this transaction sees it. If r or anything
+// read before it has changed, the snapshot is no longer consistent and the
+// transaction starts again
+func (t *transaction) read(r *ref, id int64) (value, error) {
+	if v, ok := t.writes[r]; ok {
+		return v, nil
+	}
+	v, version := r.load()
+	if seen, ok := t.reads[r]; ok && seen != version || !t.valid() {
+		return blank_value(), &txn_retry{id}
+	}
+	t.reads[r] = version
+	return v, nil
+}
+
+// commit locks every ref involved in id order, checks the reads are
+// still current, and writes everything at once
+func (t *transaction) commit() bool {
+	refs := make([]*ref, 0)
+	for r := range t.reads {
+		refs = append(refs, r)
+	}
+	for r := range t.writes {
+		if _, ok := t.reads[r]; !ok {
+			refs = append(refs, r)
+		}
+	}
+	sort.Slice(refs, func(i, j int) bool { return refs[i].id < refs[j].id })
+	for _, r := range refs {
+		r.mu.Lock()
+	}
+	defer func() {
+		for _, r := range refs {
+			r.mu.Unlock()
+		}
+	}()
+	for r, version := range t.reads {
+		if r.version != version {
+			return false
+		}
+	}
+	for r, v := range t.writes {
+		r.val = v
+		r.version++
+	}
+	return true
+}
+
+const txn_max_retries = 10000
+
+func dosyncfunc(ast *tree, bindings *env) (value, error) {
+	/* (dosync body ...) runs body as one transaction, again from the top
+	whenever another transaction commits to a ref it has read. Nothing is
+	written unless body finishes normally */
+	if ast.next == nil {
+		return blank_value(), errors.New("usage: (dosync body[ body ...])")
+	}
+	if t, _ := current_txn(bindings); t != nil {
+		/* nested dosyncs join the outer transaction */
+		return prognfunc(ast.next, bindings)
+	}
+	id := next_frame_id()
+	defer transactions.Delete(id)
+	local := new_env(make(map[string]value), bindings)
+	local.set(txn_key, value_number_int_init(id))
+	for i := 0; i < txn_max_retries; i++ {
+		t := &transaction{make(map[*ref]int64), make(map[*ref]value)}
+		transactions.Store(id, t)
+		r, err := prognfunc(ast.next, local)
+		if retry, ok := err.(*txn_retry); ok && retry.id == id {
+			continue
+		}
+		if err != nil {
+			return blank_value(), err
+		}
+		if t.commit() {
+			return r, nil
+		}
+	}
+	return blank_value(), new_error("transaction-error", "dosync gave up after %d retries", txn_max_retries)
+}
+
+var ref_ids int64
+
+func reffunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if form == "ref" {
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (ref value)")
+		}
+		return value_ref_init(&ref{id: atomic.AddInt64(&ref_ids, 1), val: args[0]}), nil
+	}
+	if len(args) == 0 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s ref ...)", form))
+	}
+	if form == "deref" {
+		/* (deref x) reads an atom, or a ref as the transaction sees it */
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (deref atom-or-ref)")
+		}
+		switch args[0].valtype {
+		case t_atom:
+			v, _ := args[0].atom().load()
+			return v, nil
+		case t_ref:
+			if t, id := current_txn(bindings); t != nil {
+				return t.read(args[0].ref(), id)
+			}
+			v, _ := args[0].ref().load()
+			return v, nil
+		}
+		return blank_value(), new_error("type-error", "deref expects an atom or a ref, given %s", typenames[args[0].valtype])
+	}
+	if args[0].valtype != t_ref {
+		return blank_value(), new_error("type-error", "%s expects a ref, given %s", form, typenames[args[0].valtype])
+	}
+	r := args[0].ref()
+	t, id := current_txn(bindings)
+	if t == nil {
+		return blank_value(), new_error("transaction-error", "%s outside of dosync", form)
+	}
+	switch form {
+	case "ref-set":
+		/* (ref-set r v) */
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (ref-set ref value)")
+		}
+		t.writes[r] = args[1]
+		return args[1], nil
+	case "alter":
+		/* (alter r f extra ...) sets r to (f current extra ...) */
+		if len(args) < 2 {
+			return blank_value(), errors.New("usage: (alter ref function[ arg ...])")
+		}
+		old, e1 := t.read(r, id)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		nv, e2 := applyfn(args[1], append([]value{old}, args[2:]...), bindings)
+		if e2 != nil {
+			return blank_value(), e2
+		}
+		t.writes[r] = nv
+		return nv, nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown ref operation %s", form))
+}
+
+// timers and on-receive don't call radu themselves; they post events to
+// the event loop, and run-event-loop calls them one at a time on whichever
+// goroutine is running it. pending counts the timers and channels that may
+// still post something, so the loop knows when it has run out of work
+type event func(bindings *env) error
+
+var event_queue = make(chan event, 64)
+var event_pending int64
+var event_wake = make(chan struct{}, 1)
+var event_stop = make(chan struct{}, 1)
+
+func post_event(ev event) {
+	event_queue <- ev
+}
+
+/* wake lets a waiting loop notice that pending has changed */
+func wake_event_loop() {
+	select {
+	case event_wake <- struct{}{}:
+	default:
+	}
+}
+
+func finish_pending() {
+	atomic.AddInt64(&event_pending, -1)
+	wake_event_loop()
+}
+
+const (
+	timer_armed     = iota
+	timer_fired     = iota
+	timer_cancelled = iota
+)
+
+// mu guards state and t, so a cancel-timer from any task can't race
+// with the event loop re-arming an every timer
+type timer struct {
+	mu     sync.Mutex
+	state  int
+	t      *time.Timer
+	period time.Duration
+	repeat bool
+	fn     value
+}
+
+// arm starts the wait for the next call, unless the timer has been
+// cancelled meanwhile
+func (t *timer) arm() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != timer_armed {
+		return
+	}
+	t.t = time.AfterFunc(t.period, func() {
+		post_event(t.fire)
+	})
+}
+
+// fire runs on the event loop. A timer cancelled after it went off but
+// before the loop got to it does nothing
+func (t *timer) fire(bindings *env) error {
+	t.mu.Lock()
+	if t.state != timer_armed {
+		t.mu.Unlock()
+		return nil
+	}
+	if !t.repeat {
+		t.state = timer_fired
+	}
+	t.mu.Unlock()
+	if !t.repeat {
+		defer finish_pending()
+		_, err := applyfn(t.fn, make([]value, 0), bindings)
+		return err
+	}
+	_, err := applyfn(t.fn, make([]value, 0), bindings)
+	/* every waits its period again from the end of each call */
+	t.arm()
+	return err
+}
+
+func (t *timer) cancel() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state != timer_armed {
+		return false
+	}
+	t.state = timer_cancelled
+	t.t.Stop()
+	finish_pending()
+	return true
+}
+
+func millis(v value, form string) (time.Duration, error) {
+	if (v.valtype != t_number_int && v.valtype != t_number_float) || num2float(v) < 0 {
+		return 0, new_error("type-error", "%s expects a number of milliseconds, given %s", form, value_string(v))
+	}
+	return time.Duration(num2float(v) * float64(time.Millisecond)), nil
+}
+
+func timerfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "after", "every":
+		/* (after ms thunk), (every ms thunk) */
+		if len(args) != 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s ms thunk)", form))
+		}
+		d, e1 := millis(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if args[1].valtype != t_function && args[1].valtype != t_primitive {
+			return blank_value(), new_error("type-error", "%s expects a procedure, given %s", form, typenames[args[1].valtype])
+		}
+		t := &timer{state: timer_armed, period: d, repeat: form == "every", fn: args[1]}
+		atomic.AddInt64(&event_pending, 1)
+		t.arm()
+		return value_timer_init(t), nil
+	case "cancel-timer":
+		/* #t if the timer was stopped, #f if it had already gone off or
+		been cancelled */
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (cancel-timer timer)")
+		}
+		if args[0].valtype != t_timer {
+			return blank_value(), new_error("type-error", "cancel-timer expects a timer, given %s", typenames[args[0].valtype])
+		}
+		if args[0].timer().cancel() {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "sleep":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (sleep ms)")
+		}
+		d, e1 := millis(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		time.Sleep(d)
+		return blank_value(), nil
+	case "on-receive":
+		/* (on-receive ch f) calls f on the event loop with each value sent
+		to ch, until ch is closed */
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (on-receive channel function)")
+		}
+		c, e1 := channel_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		fn := args[1]
+		atomic.AddInt64(&event_pending, 1)
+		go func() {
+			for v := range c.ch {
+				got := v
+				post_event(func(b *env) error {
+					_, err := applyfn(fn, []value{got}, b)
+					return err
+				})
+			}
+			post_event(func(b *env) error {
+				finish_pending()
+				return nil
+			})
+		}()
+		return blank_value(), nil
+	case "stop-event-loop":
+		select {
+		case event_stop <- struct{}{}:
+		default:
+		}
+		return blank_value(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown timer operation %s", form))
+}
+
+func runeventloopfunc(ast *tree, bindings *env) (value, error) {
+	/* (run-event-loop [ms]) runs callbacks as they come due until there
+	are no timers or channels left to wait for, stop-event-loop is called,
+	or ms have passed. An error in a callback stops the loop and is raised
+	from here */
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if len(args) > 1 {
+		return blank_value(), errors.New("usage: (run-event-loop [ms])")
+	}
+	var deadline <-chan time.Time
+	if len(args) == 1 {
+		d, e1 := millis(args[0], "run-event-loop")
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		deadline = time.After(d)
+	}
+	/* a stop left over from an earlier loop shouldn't end this one */
+	select {
+	case <-event_stop:
+	default:
+	}
+	for {
+		if atomic.LoadInt64(&event_pending) == 0 && len(event_queue) == 0 {
+			return blank_value(), nil
+		}
+		select {
+		case ev := <-event_queue:
+			if err := ev(bindings); err != nil {
+				return blank_value(), err
+			}
+		case <-event_wake:
+		case <-event_stop:
+			return blank_value(), nil
+		case <-deadline:
+			return blank_value(), nil
+		}
+	}
+}
+
+// an actor is a task with a mailbox. Anyone may append to mail; only
+// receive! takes messages out, and recv keeps two receivers on the same
+// mailbox from taking the same message
+type actor struct {
+	id      int64
+	mu      sync.Mutex
+	recv    sync.Mutex
+	mail    []value
+	arrived chan struct{}
+	task    *task
+	dead    bool
+	/* links hear about it if this actor dies with an error; monitors
+	hear about it however it ends */
+	links    []*actor
+	monitors []*actor
+}
+
+const self_key = " self"
+
+var actor_ids int64
+
+func new_actor() *actor {
+	return &actor{id: atomic.AddInt64(&actor_ids, 1), arrived: make(chan struct{}, 1), task: &task{make(chan struct{}), blank_value(), nil}}
+}
+
+// code that isn't running in an actor, the repl or a script, still has a
+// mailbox, so it can talk to the actors it starts
+var root_actor = new_actor()
+
+func current_actor(bindings *env) *actor {
+	for b := bindings; b != nil; b = b.prev {
+		if a, ok := b.get(self_key); ok {
+			return a.actor()
+		}
+		if _, ok := b.get(task_key); ok {
+			break
+		}
+	}
+	return root_actor
+}
+
+func (a *actor) deliver(msg value) {
+	a.mu.Lock()
+	a.mail = append(a.mail, msg)
+	a.mu.Unlock()
+	select {
+	case a.arrived <- struct{}{}:
+	default:
+	}
+}
+
+/* die records how a ended and tells its links and monitors */
+func (a *actor) die(result value, err error) {
+	a.mu.Lock()
+	a.task.result, a.task.err = result, err
+	a.dead = true
+	links, monitors := a.links, a.monitors
+	a.mu.Unlock()
+	close(a.task.done)
+	for _, l := range links {
+		if err != nil {
+			l.deliver(list_from_values([]value{value_symbol_init([]rune("exit")), value_pid_init(a), exit_reason(err)}))
+		}
+	}
+	for _, m := range monitors {
+		m.deliver(list_from_values([]value{value_symbol_init([]rune("down")), value_pid_init(a), exit_reason(err)}))
+	}
+}
+
+/* the reason in an exit or down message: normal, or the error object */
+func exit_reason(err error) value {
+	if err == nil {
+		return value_symbol_init([]rune("normal"))
+	}
+	if is_control(err) {
+		return error_object(new_error("control-error", "actor exited by a control transfer"))
+	}
+	return error_object(err)
+}
+
+// watch adds w to a's links or monitors, or, if a is already dead, tells
+// w straight away
+func (a *actor) watch(w *actor, link bool) {
+	a.mu.Lock()
+	if !a.dead {
+		if link {
+			a.links = append(a.links, w)
+		} else {
+			a.monitors = append(a.monitors, w)
+		}
+		a.mu.Unlock()
+		return
+	}
+	a.mu.Unlock()
+	if link && a.task.err != nil {
+		w.deliver(list_from_values([]value{value_symbol_init([]rune("exit")), value_pid_init(a), exit_reason(a.task.err)}))
+	} else if !link {
+		w.deliver(list_from_values([]value{value_symbol_init([]rune("down")), value_pid_init(a), exit_reason(a.task.err)}))
+	}
+}
+
+func pid_arg(v value, form string) (*actor, error) {
+	if v.valtype != t_pid {
+		return nil, new_error("type-error", "%s expects a pid, given %s", form, typenames[v.valtype])
+	}
+	return v.actor(), nil
+}
+
+func actorfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "spawn-actor":
+		/* (spawn-actor f arg ...) runs (f arg ...) as a new actor */
+		if len(args) == 0 {
+			return blank_value(), errors.New("usage: (spawn-actor function[ arg ...])")
+		}
+		if args[0].valtype != t_function && args[0].valtype != t_primitive {
+			return blank_value(), new_error("type-error", "spawn-actor expects a procedure, given %s", typenames[args[0].valtype])
+		}
+		a := new_actor()
+		local := new_env(make(map[string]value), bindings)
+		local.set(task_key, truesym())
+		local.set(self_key, value_pid_init(a))
+		go func() {
+			r, err := applyfn(args[0], args[1:], local)
+			a.die(r, err)
+		}()
+		return value_pid_init(a), nil
+	case "self":
+		if len(args) != 0 {
+			return blank_value(), errors.New("usage: (self)")
+		}
+		return value_pid_init(current_actor(bindings)), nil
+	case "send!":
+		/* (send! pid msg) never blocks; a dead actor's mail is dropped */
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (send! pid message)")
+		}
+		a, e1 := pid_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		a.deliver(args[1])
+		return args[1], nil
+	case "link", "monitor":
+		/* (link pid) ties the caller and pid together: if either dies
+		with an error the other gets (exit pid error). (monitor pid) gets
+		the caller (down pid reason) when pid ends for any reason */
+		if len(args) != 1 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s pid)", form))
+		}
+		a, e1 := pid_arg(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		me := current_actor(bindings)
+		a.watch(me, form == "link")
+		if form == "link" {
+			me.watch(a, true)
+		}
+		return args[0], nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown actor operation %s", form))
+}
+
+func mailboxreceivefunc(ast *tree, bindings *env) (value, error) {
+	/* (receive! (pattern[ #:when guard] body ...) ... (after ms body ...))
+	takes the oldest message that some clause matches, trying the clauses
+	in order, and leaves the rest in the mailbox. With after, gives up
+	once ms have passed with nothing matching */
+	usage := errors.New("usage: (receive! (pattern[ #:when guard] body ...) ...[ (after ms body ...)])")
+	if ast.next == nil {
+		return blank_value(), usage
+	}
+	clauses := make([]*tree, 0)
+	var timeout *tree
+	for c := ast.next; c != nil; c = c.next {
+		if c.val.valtype != t_tree || c.val.ast == nil || c.val.ast.next == nil {
+			return blank_value(), usage
+		}
+		if sym_is(c.val.ast.val, "after") {
+			timeout = c.val.ast.next
+			continue
+		}
+		clauses = append(clauses, c.val.ast)
+	}
+	var deadline <-chan time.Time
+	if timeout != nil {
+		ms, e := eval2(timeout, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		d, e1 := millis(ms, "receive!")
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		deadline = time.After(d)
+	}
+	a := current_actor(bindings)
+	body, local, e := a.take(clauses, deadline, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if body != nil {
+		return prognfunc(body, local)
+	}
+	/* timed out */
+	if timeout.next == nil {
+		return blank_value(), nil
+	}
+	return prognfunc(timeout.next, bindings)
+}
+
+// take waits for the oldest message one of the clauses matches, removes
+// it from the mailbox and gives back the clause's body with the env to run
+// it in. body is nil if the deadline passes first. The body is run by the
+// caller, after recv is released, so it may receive again
+func (a *actor) take(clauses []*tree, deadline <-chan time.Time, bindings *env) (*tree, *env, error) {
+	a.recv.Lock()
+	defer a.recv.Unlock()
+	seen := 0
+	for {
+		a.mu.Lock()
+		mail := a.mail
+		a.mu.Unlock()
+		/* a message no clause wanted won't be wanted next time round */
+		for i := seen; i < len(mail); i++ {
+			for _, c := range clauses {
+				body, local, e := match_clause(c, mail[i], bindings)
+				if e != nil {
+					return nil, nil, e
+				}
+				if body == nil {
+					continue
+				}
+				a.mu.Lock()
+				a.mail = append(a.mail[:i:i], a.mail[i+1:]...)
+				a.mu.Unlock()
+				return body, local, nil
+			}
+		}
+		seen = len(mail)
+		select {
+		case <-a.arrived:
+		case <-deadline:
+			return nil, nil, nil
+		}
+	}
+}
+
+// a promise computes its value the first time it is forced and keeps
+// it. Either expr is evaluated in env, or fn is called. It isn't locked
+// while it runs, so forcing it again from inside itself works; if two
+// tasks force it at once, the first value to arrive is kept
+type promise struct {
+	mu   sync.Mutex
+	done bool
+	val  value
+	expr *tree
+	env  *env
+	fn   func() (value, error)
+}
+
+func (p *promise) force() (value, error) {
+	p.mu.Lock()
+	if p.done {
+		p.mu.Unlock()
+		return p.val, nil
+	}
+	p.mu.Unlock()
+	var v value
+	var err error
+	if p.fn != nil {
+		v, err = p.fn()
+	} else {
+		v, err = eval2(p.expr, p.env)
+	}
+	/* an error isn't kept; the next force tries again */
+	if err != nil {
+		return blank_value(), err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.done {
+		p.val, p.done = v, true
+		p.expr, p.env, p.fn = nil, nil, nil
+	}
+	return p.val, nil
+}
+
+func force_value(v value) (value, error) {
+	if v.valtype != t_promise {
+		return v, nil
+	}
+	return v.promise().force()
+}
+
+func promisefunc(ast *tree, bindings *env, form string) (value, error) {
+	switch form {
+	case "delay":
+		/* (delay expr) */
+		if ast.next == nil || ast.next.next != nil {
+			return blank_value(), errors.New("usage: (delay expression)")
+		}
+		return value_promise_init(&promise{expr: ast.next, env: bindings}), nil
+	case "lazy-cons":
+		/* (lazy-cons head tail) evaluates head now and tail when it's
+		first needed */
+		if ast.next == nil || ast.next.next == nil || ast.next.next.next != nil {
+			return blank_value(), errors.New("usage: (lazy-cons head tail)")
+		}
+		h, e := eval2(ast.next, bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		return stream_cons(h, &promise{expr: ast.next.next, env: bindings}), nil
+	}
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	if len(args) != 1 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s value)", form))
+	}
+	switch form {
+	case "force":
+		/* forcing anything that isn't a promise just gives it back */
+		return force_value(args[0])
+	case "make-promise":
+		if args[0].valtype == t_promise {
+			return args[0], nil
+		}
+		return value_promise_init(&promise{done: true, val: args[0]}), nil
+	case "promise?":
+		if args[0].valtype == t_promise {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown promise operation %s", form))
+}
+
+// a stream is the empty list, or a pair of a head and a promise of the
+// rest of the stream, made by lazy-cons
+func stream_cons(head value, tail *promise) value {
+	return list_from_values([]value{head, value_promise_init(tail)})
+}
+
+// stream_next splits a stream into its head and the promise of its tail;
+// ok is false for the empty stream
+func stream_next(s value, form string) (head value, tail value, ok bool, err error) {
+	vals, e := list_values(s)
+	if e == nil && len(vals) == 0 {
+		return blank_value(), blank_value(), false, nil
+	}
+	if e != nil || len(vals) != 2 || vals[1].valtype != t_promise {
+		return blank_value(), blank_value(), false, new_error("type-error", "%s expects a stream, given %s", form, value_string(s))
+	}
+	return vals[0], vals[1], true, nil
+}
+
+func stream_map(fn value, s value, bindings *env) (value, error) {
+	h, t, ok, e := stream_next(s, "stream-map")
+	if e != nil || !ok {
+		return list_from_values(make([]value, 0)), e
+	}
+	v, e1 := applyfn(fn, []value{h}, bindings)
+	if e1 != nil {
+		return blank_value(), e1
+	}
+	return stream_cons(v, &promise{fn: func() (value, error) {
+		rest, e2 := t.promise().force()
+		if e2 != nil {
+			return blank_value(), e2
+		}
+		return stream_map(fn, rest, bindings)
+	}}), nil
+}
+
+// stream_filter forces as much of s as it takes to find the first item
+// pred accepts, and no more
+func stream_filter(pred value, s value, bindings *env) (value, error) {
+	for {
+		h, t, ok, e := stream_next(s, "stream-filter")
+		if e != nil || !ok {
+			return list_from_values(make([]value, 0)), e
+		}
+		keep, e1 := applyfn(pred, []value{h}, bindings)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if yes, e2 := istrue(keep, bindings); e2 != nil {
+			return blank_value(), e2
+		} else if yes {
+			return stream_cons(h, &promise{fn: func() (value, error) {
+				rest, e3 := t.promise().force()
+				if e3 != nil {
+					return blank_value(), e3
+				}
+				return stream_filter(pred, rest, bindings)
+			}}), nil
+		}
+		rest, e3 := t.promise().force()
+		if e3 != nil {
+			return blank_value(), e3
+		}
+		s = rest
+	}
+}
+
+func streamfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "stream-car", "stream-cdr", "stream-null?":
+		if len(args) != 1 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s stream)", form))
+		}
+		h, t, ok, e1 := stream_next(args[0], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if form == "stream-null?" {
+			if ok {
+				return falsesym(), nil
+			}
+			return truesym(), nil
+		}
+		if !ok {
+			return blank_value(), new_error("type-error", "%s of the empty stream", form)
+		}
+		if form == "stream-car" {
+			return h, nil
+		}
+		return t.promise().force()
+	case "stream-map", "stream-filter":
+		/* (stream-map f stream), (stream-filter pred stream) */
+		if len(args) != 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s function stream)", form))
+		}
+		if form == "stream-map" {
+			return stream_map(args[0], args[1], bindings)
+		}
+		return stream_filter(args[0], args[1], bindings)
+	case "stream-take":
+		/* (stream-take stream n) gives a list of the first n items, or
+		fewer if the stream ends first */
+		if len(args) != 2 || args[1].valtype != t_number_int {
+			return blank_value(), errors.New("usage: (stream-take stream n)")
+		}
+		vals := make([]value, 0)
+		s := args[0]
+		for i := int64(0); i < args[1].number.intval; i++ {
+			h, t, ok, e1 := stream_next(s, form)
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			if !ok {
+				break
+			}
+			vals = append(vals, h)
+			if i+1 == args[1].number.intval {
+				break
+			}
+			rest, e2 := t.promise().force()
+			if e2 != nil {
+				return blank_value(), e2
+			}
+			s = rest
+		}
+		return list_from_values(vals), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown stream operation %s", form))
+}
+
+// a generator runs its function on its own goroutine, one yield at a
+// time: next lets it run until it yields or returns, and it waits in yield
+// until next is called again. A generator that is never run to the end
+// leaves its goroutine waiting
+type generator struct {
+	mu       sync.Mutex
+	fn       value
+	env      *env
+	resume   chan struct{}
+	out      chan gen_step
+	started  bool
+	finished bool
+}
+
+type gen_step struct {
+	val  value
+	err  error
+	done bool
+}
+
+const generator_key = " generator"
+
+func current_generator(bindings *env) *generator {
+	for b := bindings; b != nil; b = b.prev {
+		if g, ok := b.get(generator_key); ok {
+			return g.generator()
+		}
+		if _, ok := b.get(task_key); ok {
+			break
+		}
+	}
+	return nil
+}
+
+/* next gives the generator's next value, or eof once it has finished */
+func (g *generator) next() (value, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.finished {
+		return eof_value(), nil
+	}
+	if !g.started {
+		g.started = true
+		local := new_env(make(map[string]value), g.env)
+		local.set(task_key, truesym())
+		local.set(generator_key, value_generator_init(g))
+		go func() {
+			_, err := applyfn(g.fn, make([]value, 0), local)
+			g.out <- gen_step{blank_value(), err, true}
+		}()
+	} else {
+		g.resume <- struct{}{}
+	}
+	step := <-g.out
+	if step.done {
+		g.finished = true
+		if step.err != nil {
+			return blank_value(), task_error(step.err)
+		}
+		return eof_value(), nil
+	}
+	return step.val, nil
+}
+
+func generatorfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "make-generator":
+		/* (make-generator (lambda () ... (yield v) ...)) */
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (make-generator thunk)")
+		}
+		if args[0].valtype != t_function && args[0].valtype != t_primitive {
+			return blank_value(), new_error("type-error", "make-generator expects a procedure, given %s", typenames[args[0].valtype])
+		}
+		return value_generator_init(&generator{fn: args[0], env: bindings, resume: make(chan struct{}), out: make(chan gen_step)}), nil
+	case "yield":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (yield value)")
+		}
+		g := current_generator(bindings)
+		if g == nil {
+			return blank_value(), new_error("control-error", "yield outside of a generator")
+		}
+		g.out <- gen_step{args[0], nil, false}
+		<-g.resume
+		return blank_value(), nil
+	}
+	if len(args) != 1 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s generator)", form))
+	}
+	if args[0].valtype != t_generator {
+		return blank_value(), new_error("type-error", "%s expects a generator, given %s", form, typenames[args[0].valtype])
+	}
+	g := args[0].generator()
+	switch form {
+	case "next":
+		return g.next()
+	case "generator->stream":
+		return generator_stream(g)
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown generator operation %s", form))
+}
+
+// generator_stream is the rest of g's values as a stream, taking each
+// from g only when the stream gets that far
+func generator_stream(g *generator) (value, error) {
+	v, e := g.next()
+	if e != nil {
+		return blank_value(), e
+	}
+	if v.valtype == t_eof {
+		return list_from_values(make([]value, 0)), nil
+	}
+	return stream_cons(v, &promise{fn: func() (value, error) {
+		return generator_stream(g)
+	}}), nil
+}
+
+// a hash table keeps its entries in the order they were first added,
+// under the key hash_key gives them, so keys that are equal? share an
+// entry
+type hashtable struct {
+	mu      sync.RWMutex
+	entries map[string]*hash_entry
+	order   []string
+	/* bumped by every change, so hash-update! can tell whether the table
+	moved on while its function ran */
+	version int64
+}
+
+type hash_entry struct {
+	key value
+	val value
+}
+
+func new_hashtable() *hashtable {
+	return &hashtable{entries: make(map[string]*hash_entry), order: make([]string, 0)}
+}
+
+// hash_key encodes v so that two values get the same key exactly when
+// they are equal?. Values with identity, like atoms and channels, are
+// keyed by where they live
+func hash_key(v value) string {
+	switch v.valtype {
+	case t_symbol, t_head_symbol:
+		if v.uninterned {
+			return fmt.Sprintf("u%p", &v.symbol[0])
+		}
+		return fmt.Sprintf("s%d:%s", len(v.symbol), string(v.symbol))
+	case t_number_int:
+		return fmt.Sprintf("i%d", v.number.intval)
+	case t_number_float:
+		return "f" + strconv.FormatFloat(v.number.floatval, 'g', -1, 64)
+	case t_tree:
+		vals, _ := list_values(v)
+		keys := make([]string, len(vals))
+		for i, x := range vals {
+			keys[i] = hash_key(x)
+		}
+		return "(" + strings.Join(keys, " ") + ")"
+	case t_function:
+		return fmt.Sprintf("l%p", v.function.action)
+	case t_primitive, t_error, t_hash, t_atom, t_ref, t_channel, t_task, t_timer, t_pid,
+		t_promise, t_generator, t_object:
+		return fmt.Sprintf("%s@%p", typenames[v.valtype], v.obj)
+	case t_vector:
+		items := v.vector().snapshot()
+		keys := make([]string, len(items))
+		for i, x := range items {
+			keys[i] = hash_key(x)
+		}
+		return "#(" + strings.Join(keys, " ") + ")"
+	case t_record:
+		fields := v.record().snapshot()
+		keys := make([]string, len(fields))
+		for i, x := range fields {
+			keys[i] = hash_key(x)
+		}
+		return fmt.Sprintf("r%p(", v.record().rtype) + strings.Join(keys, " ") + ")"
+	case t_char:
+		return fmt.Sprintf("c%d", v.symbol[0])
+	case t_regexp:
+		return "x" + v.rx().String()
+	case t_pvec:
+		items := v.pvec().items()
+		keys := make([]string, len(items))
+		for i, x := range items {
+			keys[i] = hash_key(x)
+		}
+		return "[" + strings.Join(keys, " ") + "]"
+	case t_pmap:
+		/* sorted, so equal maps get the same key however they were built */
+		keys := make([]string, 0, v.pmap().count)
+		v.pmap().root.each(func(e pmap_entry) {
+			keys = append(keys, e.hkey+" "+hash_key(e.val))
+		})
+		sort.Strings(keys)
+		return "{" + strings.Join(keys, " ") + "}"
+	}
+	return fmt.Sprintf("%s:%s", typenames[v.valtype], value_string(v))
+}
+
+func (h *hashtable) get(k value) (value, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if e, ok := h.entries[hash_key(k)]; ok {
+		return e.val, true
+	}
+	return blank_value(), false
+}
+
+// load is get along with the version of the table it was read from
+func (h *hashtable) load(k value) (value, bool, int64) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	if e, ok := h.entries[hash_key(k)]; ok {
+		return e.val, true, h.version
+	}
+	return blank_value(), false, h.version
+}
+
+func (h *hashtable) set(k value, v value) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.put(k, v)
+}
+
+// set_if sets k only if nothing has changed the table since version
+func (h *hashtable) set_if(k value, v value, version int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.version != version {
+		return false
+	}
+	h.put(k, v)
+	return true
+}
+
+// put sets k with mu held
+func (h *hashtable) put(k value, v value) {
+	key := hash_key(k)
+	h.version++
+	if e, ok := h.entries[key]; ok {
+		e.val = v
+		return
+	}
+	h.entries[key] = &hash_entry{k, v}
+	h.order = append(h.order, key)
+}
+
+func (h *hashtable) remove(k value) bool {
+	key := hash_key(k)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.entries[key]; !ok {
+		return false
+	}
+	delete(h.entries, key)
+	h.version++
+	for i, o := range h.order {
+		if o == key {
+			h.order = append(h.order[:i:i], h.order[i+1:]...)
+			break
+		}
+	}
+	return true
+}
+
+// pairs is a snapshot of the entries, so callers can run radu code over
+// them without holding the lock
+func (h *hashtable) pairs() []hash_entry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	ps := make([]hash_entry, len(h.order))
+	for i, key := range h.order {
+		ps[i] = *h.entries[key]
+	}
+	return ps
+}
+
+/* hash_from_pairs fills a new table from entries written (k v) or (k . v) */
+func hash_from_pairs(entries []value, form string) (*hashtable, error) {
+	h := new_hashtable()
+	for _, e := range entries {
+		kv, err := list_values(e)
+		if err == nil && len(kv) == 3 && sym_is(kv[1], ".") {
+			kv = []value{kv[0], kv[2]}
+		}
+		if err != nil || len(kv) != 2 {
+			return nil, new_error("type-error", "%s expects entries like (key value), given %s", form, value_string(e))
+		}
+		h.set(kv[0], kv[1])
+	}
+	return h, nil
+}
+
+// hash_literal builds the table for #hash((k v) ...); like a quoted list,
+// nothing inside it is evaluated
+func hash_literal(v value) (value, error) {
+	h, e := hash_from_pairs(quote_members(v), "#hash")
+	if e != nil {
+		return blank_value(), e
+	}
+	return value_hash_init(h), nil
+}
+
+func hashfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "make-hash":
+		/* (make-hash), or (make-hash (list (list k v) ...)) */
+		if len(args) > 1 {
+			return blank_value(), errors.New("usage: (make-hash [list-of-pairs])")
+		}
+		if len(args) == 0 {
+			return value_hash_init(new_hashtable()), nil
+		}
+		entries, e1 := list_values(args[0])
+		if e1 != nil {
+			return blank_value(), new_error("type-error", "make-hash expects a list of pairs, given %s", typenames[args[0].valtype])
+		}
+		h, e2 := hash_from_pairs(entries, form)
+		if e2 != nil {
+			return blank_value(), e2
+		}
+		return value_hash_init(h), nil
+	case "hash":
+		/* (hash k v k v ...) */
+		if len(args)%2 != 0 {
+			return blank_value(), errors.New("usage: (hash key value ...)")
+		}
+		h := new_hashtable()
+		for i := 0; i < len(args); i += 2 {
+			h.set(args[i], args[i+1])
+		}
+		return value_hash_init(h), nil
+	case "hash?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (hash? value)")
+		}
+		if args[0].valtype == t_hash {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	if len(args) == 0 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s hash ...)", form))
+	}
+	if args[0].valtype != t_hash {
+		return blank_value(), new_error("type-error", "%s expects a hash table, given %s", form, typenames[args[0].valtype])
+	}
+	h := args[0].hash()
+	switch form {
+	case "hash-ref":
+		/* (hash-ref h k [default]); a default that is a function is called
+		to make the value */
+		if len(args) != 2 && len(args) != 3 {
+			return blank_value(), errors.New("usage: (hash-ref hash key [default])")
+		}
+		if v, ok := h.get(args[1]); ok {
+			return v, nil
+		}
+		if len(args) == 2 {
+			return blank_value(), &radu_error{value_error_init([]rune("key-error"), "no value for key in hash table", []value{args[1]}), nil, make([]frame, 0), false}
+		}
+		if args[2].valtype == t_function || args[2].valtype == t_primitive {
+			return applyfn(args[2], make([]value, 0), bindings)
+		}
+		return args[2], nil
+	case "hash-set!":
+		if len(args) != 3 {
+			return blank_value(), errors.New("usage: (hash-set! hash key value)")
+		}
+		h.set(args[1], args[2])
+		return args[2], nil
+	case "hash-update!":
+		/* (hash-update! h k f [default]) sets k to (f current). Like swap!,
+		f runs again if another task changes h meanwhile */
+		if len(args) != 3 && len(args) != 4 {
+			return blank_value(), errors.New("usage: (hash-update! hash key function [default])")
+		}
+		for {
+			old, ok, version := h.load(args[1])
+			if !ok {
+				if len(args) == 3 {
+					return blank_value(), &radu_error{value_error_init([]rune("key-error"), "no value for key in hash table", []value{args[1]}), nil, make([]frame, 0), false}
+				}
+				old = args[3]
+			}
+			v, e1 := applyfn(args[2], []value{old}, bindings)
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			if h.set_if(args[1], v, version) {
+				return v, nil
+			}
+		}
+	case "hash-remove!":
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (hash-remove! hash key)")
+		}
+		if h.remove(args[1]) {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "hash-has-key?":
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (hash-has-key? hash key)")
+		}
+		if _, ok := h.get(args[1]); ok {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "hash-count":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (hash-count hash)")
+		}
+		return value_number_int_init(int64(len(h.pairs()))), nil
+	case "hash-keys", "hash-values", "hash->list":
+		if len(args) != 1 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s hash)", form))
+		}
+		return list_from_values(hash_items(h, form)), nil
+	case "hash-for-each", "hash-map":
+		/* (hash-for-each h f) calls (f k v) for every entry; hash-map
+		gives back a list of the results */
+		if len(args) != 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s hash function)", form))
+		}
+		results := make([]value, 0)
+		for _, p := range h.pairs() {
+			r, e1 := applyfn(args[1], []value{p.key, p.val}, bindings)
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			results = append(results, r)
+		}
+		if form == "hash-map" {
+			return list_from_values(results), nil
+		}
+		return blank_value(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown hash operation %s", form))
+}
+
+func hash_items(h *hashtable, form string) []value {
+	items := make([]value, 0)
+	for _, p := range h.pairs() {
+		switch form {
+		case "hash-keys":
+			items = append(items, p.key)
+		case "hash-values":
+			items = append(items, p.val)
+		default:
+			items = append(items, list_from_values([]value{p.key, p.val}))
+		}
+	}
+	return items
+}
+
+// a vector is a Go slice, so indexing and setting take the same time
+// wherever they are
+type vector struct {
+	mu    sync.RWMutex
+	items []value
+}
+
+/* snapshot copies the items so radu code can run over them unlocked */
+func (v *vector) snapshot() []value {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return append(make([]value, 0, len(v.items)), v.items...)
+}
+
+func (v *vector) length() int {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return len(v.items)
+}
+
+// vector_literal builds #(a b c); like a quoted list, nothing inside it
+// is evaluated
+func vector_literal(v value) value {
+	return value_vector_init(&vector{items: quote_members(v)})
+}
+
+func vector_index(v *vector, i value, form string, end bool) (int, error) {
+	n := v.length()
+	limit := n - 1
+	if end {
+		limit = n
+	}
+	if i.valtype != t_number_int {
+		return 0, new_error("type-error", "%s expects an integer index, given %s", form, typenames[i.valtype])
+	}
+	if i.number.intval < 0 || i.number.intval > int64(limit) {
+		return 0, &radu_error{value_error_init([]rune("range-error"), fmt.Sprintf("%s index %d out of range for vector of length %d", form, i.number.intval, n), make([]value, 0)), nil, make([]frame, 0), false}
+	}
+	return int(i.number.intval), nil
+}
+
+func vectorfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "vector":
+		return value_vector_init(&vector{items: args}), nil
+	case "make-vector":
+		/* (make-vector n [fill]) */
+		if len(args) != 1 && len(args) != 2 {
+			return blank_value(), errors.New("usage: (make-vector length [fill])")
+		}
+		if args[0].valtype != t_number_int || args[0].number.intval < 0 {
+			return blank_value(), new_error("type-error", "make-vector expects a length of 0 or more, given %s", value_string(args[0]))
+		}
+		fill := value_number_int_init(0)
+		if len(args) == 2 {
+			fill = args[1]
+		}
+		items := make([]value, args[0].number.intval)
+		for i := range items {
+			items[i] = fill
+		}
+		return value_vector_init(&vector{items: items}), nil
+	case "list->vector":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (list->vector list)")
+		}
+		items, e1 := list_values(args[0])
+		if e1 != nil {
+			return blank_value(), new_error("type-error", "list->vector expects a list, given %s", typenames[args[0].valtype])
+		}
+		return value_vector_init(&vector{items: items}), nil
+	case "vector?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (vector? value)")
+		}
+		if args[0].valtype == t_vector {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "vector-map", "vector-for-each":
+		/* (vector-map f v) gives a new vector of (f item) for each item */
+		if len(args) != 2 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s function vector)", form))
+		}
+		if args[1].valtype != t_vector {
+			return blank_value(), new_error("type-error", "%s expects a vector, given %s", form, typenames[args[1].valtype])
+		}
+		items := args[1].vector().snapshot()
+		for i, x := range items {
+			r, e1 := applyfn(args[0], []value{x}, bindings)
+			if e1 != nil {
+				return blank_value(), e1
+			}
+			items[i] = r
+		}
+		if form == "vector-for-each" {
+			return blank_value(), nil
+		}
+		return value_vector_init(&vector{items: items}), nil
+	}
+	if len(args) == 0 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s vector ...)", form))
+	}
+	if args[0].valtype != t_vector {
+		return blank_value(), new_error("type-error", "%s expects a vector, given %s", form, typenames[args[0].valtype])
+	}
+	v := args[0].vector()
+	switch form {
+	case "vector-length":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (vector-length vector)")
+		}
+		return value_number_int_init(int64(v.length())), nil
+	case "vector-ref":
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (vector-ref vector index)")
+		}
+		i, e1 := vector_index(v, args[1], form, false)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		v.mu.RLock()
+		defer v.mu.RUnlock()
+		return v.items[i], nil
+	case "vector-set!":
+		if len(args) != 3 {
+			return blank_value(), errors.New("usage: (vector-set! vector index value)")
+		}
+		i, e1 := vector_index(v, args[1], form, false)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		v.mu.Lock()
+		defer v.mu.Unlock()
+		v.items[i] = args[2]
+		return args[2], nil
+	case "vector->list":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (vector->list vector)")
+		}
+		return list_from_values(v.snapshot()), nil
+	case "vector-slice":
+		/* (vector-slice v start [end]) copies items start to end-1 */
+		if len(args) != 2 && len(args) != 3 {
+			return blank_value(), errors.New("usage: (vector-slice vector start [end])")
+		}
+		start, e1 := vector_index(v, args[1], form, true)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		items := v.snapshot()
+		end := len(items)
+		if len(args) == 3 {
+			var e2 error
+			if end, e2 = vector_index(v, args[2], form, true); e2 != nil {
+				return blank_value(), e2
+			}
+		}
+		if end < start {
+			return blank_value(), &radu_error{value_error_init([]rune("range-error"), fmt.Sprintf("vector-slice end %d is before start %d", end, start), make([]value, 0)), nil, make([]frame, 0), false}
+		}
+		return value_vector_init(&vector{items: append(make([]value, 0, end-start), items[start:end]...)}), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown vector operation %s", form))
+}
+
+// persistent collections never change; every update makes a new version
+// that shares all the nodes it didn't touch with the old one, so any
+// version can be handed to other tasks without locking.
+//
+// A persistent map is a hash array mapped trie: each level uses 5 bits of
+// the key's hash to pick one of up to 32 children, and the bitmap says
+// which of them exist so only those are stored. A leaf holds the entries
+// whose hashes are equal, which is nearly always just one.
+type pmap_entry struct {
+	hkey string
+	key  value
+	val  value
+}
+
+type hamt_node struct {
+	bitmap   uint32
+	children []*hamt_node
+	hash     uint32
+	entries  []pmap_entry
+}
+
+type persistent_map struct {
+	root  *hamt_node
+	count int
+}
+
+func (n *hamt_node) leaf() bool {
+	return n.entries != nil
+}
+
+func key_hash(hkey string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(hkey))
+	return h.Sum32()
+}
+
+func (n *hamt_node) slot(hash uint32, shift uint) (uint32, int) {
+	bit := uint32(1) << ((hash >> shift) & 31)
+	return bit, bits.OnesCount32(n.bitmap & (bit - 1))
+}
+
+func (n *hamt_node) find(hash uint32, hkey string, shift uint) (pmap_entry, bool) {
+	for n != nil && !n.leaf() {
+		bit, pos := n.slot(hash, shift)
+		if n.bitmap&bit == 0 {
+			return pmap_entry{}, false
+		}
+		n = n.children[pos]
+		shift += 5
+	}
+	if n != nil && n.hash == hash {
+		for _, e := range n.entries {
+			if e.hkey == hkey {
+				return e, true
+			}
+		}
+	}
+	return pmap_entry{}, false
+}
+
+/* assoc gives a new node with e added or replaced, and whether it added */
+func (n *hamt_node) assoc(hash uint32, e pmap_entry, shift uint) (*hamt_node, bool) {
+	if n.leaf() {
+		if n.hash == hash {
+			entries := append(make([]pmap_entry, 0, len(n.entries)+1), n.entries...)
+			for i, old := range entries {
+				if old.hkey == e.hkey {
+					entries[i] = e
+					return &hamt_node{hash: hash, entries: entries}, false
+				}
+			}
+			return &hamt_node{hash: hash, entries: append(entries, e)}, true
+		}
+		/* a different hash: put this leaf under a new branch, then add e
+		to that */
+		bit, _ := (&hamt_node{}).slot(n.hash, shift)
+		branch := &hamt_node{bitmap: bit, children: []*hamt_node{n}}
+		return branch.assoc(hash, e, shift)
+	}
+	bit, pos := n.slot(hash, shift)
+	children := append(make([]*hamt_node, 0, len(n.children)+1), n.children...)
+	if n.bitmap&bit == 0 {
+		leaf := &hamt_node{hash: hash, entries: []pmap_entry{e}}
+		children = append(children[:pos], append([]*hamt_node{leaf}, children[pos:]...)...)
+		return &hamt_node{bitmap: n.bitmap | bit, children: children}, true
+	}
+	child, added := children[pos].assoc(hash, e, shift+5)
+	children[pos] = child
+	return &hamt_node{bitmap: n.bitmap, children: children}, added
+}
+
+// dissoc gives a new node without hkey (nil if nothing is left), and
+// whether it was there
+func (n *hamt_node) dissoc(hash uint32, hkey string, shift uint) (*hamt_node, bool) {
+	if n.leaf() {
+		if n.hash != hash {
+			return n, false
+		}
+		entries := make([]pmap_entry, 0, len(n.entries))
+		for _, e := range n.entries {
+			if e.hkey != hkey {
+				entries = append(entries, e)
+			}
+		}
+		if len(entries) == len(n.entries) {
+			return n, false
+		}
+		if len(entries) == 0 {
+			return nil, true
+		}
+		return &hamt_node{hash: hash, entries: entries}, true
+	}
+	bit, pos := n.slot(hash, shift)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+	child, removed := n.children[pos].dissoc(hash, hkey, shift+5)
+	if !removed {
+		return n, false
+	}
+	children := append(make([]*hamt_node, 0, len(n.children)), n.children...)
+	if child != nil {
+		children[pos] = child
+		return &hamt_node{bitmap: n.bitmap, children: children}, true
+	}
+	children = append(children[:pos], children[pos+1:]...)
+	if len(children) == 0 {
+		return nil, true
+	}
+	return &hamt_node{bitmap: n.bitmap &^ bit, children: children}, true
+}
+
+func (n *hamt_node) each(f func(e pmap_entry)) {
+	if n == nil {
+		return
+	}
+	for _, e := range n.entries {
+		f(e)
+	}
+	for _, c := range n.children {
+		c.each(f)
+	}
+}
+
+func (m *persistent_map) get(k value) (value, bool) {
+	hkey := hash_key(k)
+	e, ok := m.root.find(key_hash(hkey), hkey, 0)
+	return e.val, ok
+}
+
+func (m *persistent_map) assoc(k value, v value) *persistent_map {
+	hkey := hash_key(k)
+	root := m.root
+	if root == nil {
+		root = &hamt_node{}
+	}
+	root, added := root.assoc(key_hash(hkey), pmap_entry{hkey, k, v}, 0)
+	if added {
+		return &persistent_map{root, m.count + 1}
+	}
+	return &persistent_map{root, m.count}
+}
+
+func (m *persistent_map) dissoc(k value) *persistent_map {
+	if m.root == nil {
+		return m
+	}
+	hkey := hash_key(k)
+	root, removed := m.root.dissoc(key_hash(hkey), hkey, 0)
+	if !removed {
+		return m
+	}
+	return &persistent_map{root, m.count - 1}
+}
+
+func (m *persistent_map) pairs() []value {
+	ps := make([]value, 0, m.count)
+	m.root.each(func(e pmap_entry) {
+		ps = append(ps, list_from_values([]value{e.key, e.val}))
+	})
+	return ps
+}
+
+// A persistent vector is a trie of 32-way nodes holding all but the last
+// few items, which are kept in tail until it fills up, so conj seldom has
+// to touch the trie at all. shift is how many bits of an index the top
+// level uses
+type pvec_node struct {
+	children []*pvec_node
+	items    []value
+}
+
+type persistent_vector struct {
+	count int
+	shift uint
+	root  *pvec_node
+	tail  []value
+}
+
+var empty_pvec = &persistent_vector{0, 5, &pvec_node{}, make([]value, 0)}
+
+func (v *persistent_vector) tailoff() int {
+	if v.count < 32 {
+		return 0
+	}
+	return ((v.count - 1) >> 5) << 5
+}
+
+func (v *persistent_vector) nth(i int) value {
+	if i >= v.tailoff() {
+		return v.tail[i&31]
+	}
+	n := v.root
+	for level := v.shift; level > 0; level -= 5 {
+		n = n.children[(i>>level)&31]
+	}
+	return n.items[i&31]
+}
+
+func (v *persistent_vector) conj(x value) *persistent_vector {
+	if v.count-v.tailoff() < 32 {
+		tail := append(make([]value, 0, len(v.tail)+1), v.tail...)
+		return &persistent_vector{v.count + 1, v.shift, v.root, append(tail, x)}
+	}
+	/* the tail is full: it goes into the trie, growing a new level on top
+	if the trie is full too */
+	full := &pvec_node{items: v.tail}
+	root, shift := v.root, v.shift
+	if (v.count >> 5) > (1 << v.shift) {
+		root = &pvec_node{children: []*pvec_node{v.root, pvec_path(v.shift, full)}}
+		shift += 5
+	} else {
+		root = v.push_tail(v.shift, v.root, full)
+	}
+	return &persistent_vector{v.count + 1, shift, root, []value{x}}
+}
+
+func pvec_path(level uint, n *pvec_node) *pvec_node {
+	if level == 0 {
+		return n
+	}
+	return &pvec_node{children: []*pvec_node{pvec_path(level-5, n)}}
+}
+
+func (v *persistent_vector) push_tail(level uint, parent *pvec_node, full *pvec_node) *pvec_node {
+	sub := ((v.count - 1) >> level) & 31
+	children := append(make([]*pvec_node, 0, len(parent.children)+1), parent.children...)
+	var child *pvec_node
+	if level == 5 {
+		child = full
+	} else if sub < len(children) {
+		child = v.push_tail(level-5, children[sub], full)
+	} else {
+		child = pvec_path(level-5, full)
+	}
+	if sub < len(children) {
+		children[sub] = child
+	} else {
+		children = append(children, child)
+	}
+	return &pvec_node{children: children}
+}
+
+func (v *persistent_vector) assoc(i int, x value) *persistent_vector {
+	if i == v.count {
+		return v.conj(x)
+	}
+	if i >= v.tailoff() {
+		tail := append(make([]value, 0, len(v.tail)), v.tail...)
+		tail[i&31] = x
+		return &persistent_vector{v.count, v.shift, v.root, tail}
+	}
+	return &persistent_vector{v.count, v.shift, pvec_assoc(v.shift, v.root, i, x), v.tail}
+}
+
+func pvec_assoc(level uint, n *pvec_node, i int, x value) *pvec_node {
+	if level == 0 {
+		items := append(make([]value, 0, len(n.items)), n.items...)
+		items[i&31] = x
+		return &pvec_node{items: items}
+	}
+	children := append(make([]*pvec_node, 0, len(n.children)), n.children...)
+	sub := (i >> level) & 31
+	children[sub] = pvec_assoc(level-5, children[sub], i, x)
+	return &pvec_node{children: children}
+}
+
+func (v *persistent_vector) items() []value {
+	items := make([]value, v.count)
+	for i := range items {
+		items[i] = v.nth(i)
+	}
+	return items
+}
+
+func pvec_index(v *persistent_vector, i value, form string, limit int) (int, error) {
+	if i.valtype != t_number_int {
+		return 0, new_error("type-error", "%s expects an integer index, given %s", form, typenames[i.valtype])
+	}
+	if i.number.intval < 0 || i.number.intval > int64(limit) {
+		return 0, &radu_error{value_error_init([]rune("range-error"), fmt.Sprintf("%s index %d out of range for persistent vector of length %d", form, i.number.intval, v.count), make([]value, 0)), nil, make([]frame, 0), false}
+	}
+	return int(i.number.intval), nil
+}
+
+/* pget looks k up in a persistent map, or index k in a persistent vector */
+func pget(coll value, k value, form string) (value, bool, error) {
+	if coll.valtype == t_pvec {
+		i, e := pvec_index(coll.pvec(), k, form, coll.pvec().count-1)
+		if e != nil {
+			return blank_value(), false, e
+		}
+		return coll.pvec().nth(i), true, nil
+	}
+	v, ok := coll.pmap().get(k)
+	return v, ok, nil
+}
+
+func passoc(coll value, k value, v value, form string) (value, error) {
+	if coll.valtype == t_pvec {
+		i, e := pvec_index(coll.pvec(), k, form, coll.pvec().count)
+		if e != nil {
+			return blank_value(), e
+		}
+		return value_pvec_init(coll.pvec().assoc(i, v)), nil
+	}
+	return value_pmap_init(coll.pmap().assoc(k, v)), nil
+}
+
+func persistentfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "persistent-map":
+		/* (persistent-map k v k v ...) */
+		if len(args)%2 != 0 {
+			return blank_value(), errors.New("usage: (persistent-map key value ...)")
+		}
+		m := &persistent_map{}
+		for i := 0; i < len(args); i += 2 {
+			m = m.assoc(args[i], args[i+1])
+		}
+		return value_pmap_init(m), nil
+	case "persistent-vector":
+		v := empty_pvec
+		for _, x := range args {
+			v = v.conj(x)
+		}
+		return value_pvec_init(v), nil
+	case "persistent-map?", "persistent-vector?":
+		if len(args) != 1 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s value)", form))
+		}
+		if (form == "persistent-map?" && args[0].valtype == t_pmap) || (form == "persistent-vector?" && args[0].valtype == t_pvec) {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	if len(args) == 0 {
+		return blank_value(), errors.New(fmt.Sprintf("usage: (%s collection ...)", form))
+	}
+	coll := args[0]
+	if coll.valtype != t_pmap && coll.valtype != t_pvec {
+		return blank_value(), new_error("type-error", "%s expects a persistent map or vector, given %s", form, typenames[coll.valtype])
+	}
+	switch form {
+	case "assoc":
+		/* (assoc coll k v ...) */
+		if len(args) < 3 || len(args)%2 != 1 {
+			return blank_value(), errors.New("usage: (assoc collection key value[ key value ...])")
+		}
+		for i := 1; i < len(args); i += 2 {
+			var e1 error
+			if coll, e1 = passoc(coll, args[i], args[i+1], form); e1 != nil {
+				return blank_value(), e1
+			}
+		}
+		return coll, nil
+	case "dissoc":
+		/* (dissoc map k ...) */
+		if coll.valtype != t_pmap {
+			return blank_value(), new_error("type-error", "dissoc expects a persistent map, given %s", typenames[coll.valtype])
+		}
+		m := coll.pmap()
+		for _, k := range args[1:] {
+			m = m.dissoc(k)
+		}
+		return value_pmap_init(m), nil
+	case "conj":
+		/* (conj vector x ...) adds to the end; (conj map (list k v) ...) */
+		for _, x := range args[1:] {
+			if coll.valtype == t_pvec {
+				coll = value_pvec_init(coll.pvec().conj(x))
+				continue
+			}
+			kv, e1 := list_values(x)
+			if e1 != nil || len(kv) != 2 {
+				return blank_value(), new_error("type-error", "conj onto a persistent map expects (key value) pairs, given %s", value_string(x))
+			}
+			coll = value_pmap_init(coll.pmap().assoc(kv[0], kv[1]))
+		}
+		return coll, nil
+	case "get":
+		/* (get coll k [default]) */
+		if len(args) != 2 && len(args) != 3 {
+			return blank_value(), errors.New("usage: (get collection key [default])")
+		}
+		if len(args) == 3 && coll.valtype == t_pvec {
+			if i := args[1]; i.valtype == t_number_int && (i.number.intval < 0 || i.number.intval >= int64(coll.pvec().count)) {
+				return args[2], nil
+			}
+		}
+		v, ok, e1 := pget(coll, args[1], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if ok {
+			return v, nil
+		}
+		if len(args) == 3 {
+			return args[2], nil
+		}
+		return blank_value(), &radu_error{value_error_init([]rune("key-error"), "no value for key in persistent map", []value{args[1]}), nil, make([]frame, 0), false}
+	case "update":
+		/* (update coll k f arg ...) sets k to (f current arg ...) */
+		if len(args) < 3 {
+			return blank_value(), errors.New("usage: (update collection key function[ arg ...])")
+		}
+		old, ok, e1 := pget(coll, args[1], form)
+		if e1 != nil {
+			return blank_value(), e1
+		}
+		if !ok {
+			return blank_value(), &radu_error{value_error_init([]rune("key-error"), "no value for key in persistent map", []value{args[1]}), nil, make([]frame, 0), false}
+		}
+		v, e2 := applyfn(args[2], append([]value{old}, args[3:]...), bindings)
+		if e2 != nil {
+			return blank_value(), e2
+		}
+		return passoc(coll, args[1], v, form)
+	case "contains?":
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (contains? collection key)")
+		}
+		if coll.valtype == t_pvec {
+			if i := args[1]; i.valtype == t_number_int && i.number.intval >= 0 && i.number.intval < int64(coll.pvec().count) {
+				return truesym(), nil
+			}
+			return falsesym(), nil
+		}
+		if _, ok := coll.pmap().get(args[1]); ok {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown persistent collection operation %s", form))
+}
+
+// persistent_items lists a persistent vector's items, or a persistent
+// map's entries as (key value) pairs
+func persistent_items(v value) []value {
+	if v.valtype == t_pvec {
+		return v.pvec().items()
+	}
+	return v.pmap().pairs()
+}
+
+// every define-record-type makes a new record_type; its instances are
+// all t_record values, told apart by their type
+type record_type struct {
+	name   string
+	fields []string
+}
+
+type record struct {
+	rtype  *record_type
+	mu     sync.RWMutex
+	fields []value
+}
+
+func (r *record) snapshot() []value {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append(make([]value, 0, len(r.fields)), r.fields...)
+}
+
+// type_name is typenames[v.valtype], except that a record is named by
+// its own type and strings and booleans by what they are
+func type_name(v value) string {
+	switch {
+	case v.valtype == t_record:
+		return v.record().rtype.name
+	case v.valtype == t_object:
+		return v.object().class.name
+	case is_keyword(v) && len(v.decorations) == 0:
+		return "keyword"
+	case is_symbol(v) && len(v.decorations) == 0 && symisstring(v.symbol):
+		return "string"
+	case sym_is(v, "#t") || sym_is(v, "#f"):
+		return "boolean"
+	}
+	return typenames[v.valtype]
+}
+
+func typeoffunc(ast *tree, bindings *env) (value, error) {
+	if ast.next == nil || ast.next.next != nil {
+		return blank_value(), errors.New("usage: (type-of value)")
+	}
+	v, e := eval2(ast.next, bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	return value_symbol_init([]rune(type_name(v))), nil
+}
+
+var gensyms int64
+
+func symbolfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "symbol?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (symbol? value)")
+		}
+		if len(args[0].symbol) > 0 && type_name(args[0]) == "symbol" {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "symbol->string":
+		if len(args) != 1 || len(args[0].symbol) == 0 || type_name(args[0]) != "symbol" {
+			return blank_value(), errors.New("usage: (symbol->string symbol)")
+		}
+		name := string(args[0].symbol)
+		if len(name) >= 2 && name[0] == '|' && name[len(name)-1] == '|' {
+			name = name[1 : len(name)-1]
+		}
+		return value_symbol_init([]rune("\"" + name + "\"")), nil
+	case "string->symbol":
+		if len(args) != 1 || type_name(args[0]) != "string" {
+			return blank_value(), errors.New("usage: (string->symbol string)")
+		}
+		return value_symbol_init(intern([]rune(symbol_name(string(stringify(args[0].symbol)))))), nil
+	case "keyword?":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (keyword? value)")
+		}
+		if type_name(args[0]) == "keyword" {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "keyword->string":
+		if len(args) != 1 || type_name(args[0]) != "keyword" {
+			return blank_value(), errors.New("usage: (keyword->string keyword)")
+		}
+		return value_symbol_init([]rune("\"" + string(args[0].symbol[1:]) + "\"")), nil
+	case "string->keyword":
+		if len(args) != 1 || type_name(args[0]) != "string" || len(stringify(args[0].symbol)) == 0 {
+			return blank_value(), errors.New("usage: (string->keyword string)")
+		}
+		return value_symbol_init(intern([]rune(":" + string(stringify(args[0].symbol))))), nil
+	case "gensym":
+		/* (gensym[ prefix]) makes a symbol no other symbol is equal to,
+		even one with the same name */
+		prefix := "g"
+		if len(args) > 1 {
+			return blank_value(), errors.New("usage: (gensym[ prefix])")
+		}
+		if len(args) == 1 {
+			switch type_name(args[0]) {
+			case "string":
+				prefix = string(stringify(args[0].symbol))
+			case "symbol":
+				prefix = string(args[0].symbol)
+			default:
+				return blank_value(), errors.New("usage: (gensym[ prefix])")
+			}
+		}
+		g := value_symbol_init([]rune(symbol_name(fmt.Sprintf("%s%d", prefix, atomic.AddInt64(&gensyms, 1)))))
+		g.uninterned = true
+		return g, nil
+	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown symbol operation %s", form))
+}
+
+func record_arg(v value, rt *record_type, form string) (*record, error) {
+	if v.valtype != t_record || v.record().rtype != rt {
+		return nil, new_error("type-error", "%s expects a %s, given %s", form, rt.name, type_name(v))
+	}
+	return v.record(), nil
+}
+
+func definerecordtypefunc(ast *tree, bindings *env) (value, error) {
+	/* (define-record-type point (make-point x y) point?
+	   (x point-x) (y point-y set-point-y!)) */
+	usage := errors.New("usage: (define-record-type name (constructor field ...) predicate (field accessor [modifier]) ...)")
+	if ast.next == nil || ast.next.next == nil || ast.next.next.next == nil {
+		return blank_value(), usage
+	}
+	name := ast.next.val
+	cons := ast.next.next.val
+	pred := ast.next.next.next.val
+	if !is_symbol(name) || !is_symbol(pred) || cons.valtype != t_tree || cons.ast == nil || !is_symbol(cons.ast.val) {
+		return blank_value(), usage
+	}
+	rt := &record_type{string(name.symbol), make([]string, 0)}
+	index := make(map[string]int)
+	procs := make(map[string]value)
+	for f := ast.next.next.next.next; f != nil; f = f.next {
+		spec := []value{f.val}
+		if f.val.valtype == t_tree {
+			spec = tree_values(f.val.ast)
+		}
+		if len(spec) == 0 || len(spec) > 3 || !is_symbol(spec[0]) {
+			return blank_value(), usage
+		}
+		field := string(spec[0].symbol)
+		if _, dup := index[field]; dup {
+			return blank_value(), errors.New(fmt.Sprintf("error: record type %s has two fields called %s", rt.name, field))
+		}
+		i := len(rt.fields)
+		index[field] = i
+		rt.fields = append(rt.fields, field)
+		if len(spec) > 1 {
+			if !is_symbol(spec[1]) {
+				return blank_value(), usage
+			}
+			accessor := string(spec[1].symbol)
+			procs[accessor] = value_primitive_init(accessor, func(args []value, b *env) (value, error) {
+				if len(args) != 1 {
+					return blank_value(), errors.New(fmt.Sprintf("usage: (%s %s)", accessor, rt.name))
+				}
+				r, e := record_arg(args[0], rt, accessor)
+				if e != nil {
+					return blank_value(), e
+				}
+				r.mu.RLock()
+				defer r.mu.RUnlock()
+				return r.fields[i], nil
+			})
+		}
+		if len(spec) > 2 {
+			if !is_symbol(spec[2]) {
+				return blank_value(), usage
+			}
+			modifier := string(spec[2].symbol)
+			procs[modifier] = value_primitive_init(modifier, func(args []value, b *env) (value, error) {
+				if len(args) != 2 {
+					return blank_value(), errors.New(fmt.Sprintf("usage: (%s %s value)", modifier, rt.name))
+				}
+				r, e := record_arg(args[0], rt, modifier)
+				if e != nil {
+					return blank_value(), e
+				}
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				r.fields[i] = args[1]
+				return args[1], nil
+			})
+		}
+	}
+	/* the constructor's arguments fill the fields it names; any others
+	start out #f */
+	slots := make([]int, 0)
+	for _, p := range tree_values(cons.ast.next) {
+		i, ok := index[string(p.symbol)]
+		if !is_symbol(p) || !ok {
+			return blank_value(), errors.New(fmt.Sprintf("error: %s takes %s, which isn't a field of %s", string(cons.ast.val.symbol), value_string(p), rt.name))
+		}
+		slots = append(slots, i)
+	}
+	constructor := string(cons.ast.val.symbol)
+	procs[constructor] = value_primitive_init(constructor, func(args []value, b *env) (value, error) {
+		if len(args) != len(slots) {
+			return blank_value(), errors.New(fmt.Sprintf("error: %s takes %d arguments, given %d", constructor, len(slots), len(args)))
+		}
+		fields := make([]value, len(rt.fields))
+		for i := range fields {
+			fields[i] = falsesym()
+		}
+		for j, i := range slots {
+			fields[i] = args[j]
+		}
+		return value_record_init(&record{rtype: rt, fields: fields}), nil
+	})
+	predicate := string(pred.symbol)
+	procs[predicate] = value_primitive_init(predicate, func(args []value, b *env) (value, error) {
+		if len(args) != 1 {
+			return blank_value(), errors.New(fmt.Sprintf("usage: (%s value)", predicate))
+		}
+		if args[0].valtype == t_record && args[0].record().rtype == rt {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	})
+	bindings.set_all(procs)
+	return name, nil
+}
+
+func definefunc(ast *tree, bindings *env) (value, error) {
+	if ast.next != nil && ast.next.next != nil {
+		if ast.next.val.valtype != t_symbol {
+			return blank_value(), errors.New(fmt.Sprintf("error: define can't bind to a non-symbol (%s)", typenames[ast.next.val.valtype]))
+		}
+		if g, e0 := eval2(ast.next.next, bindings); e0 == nil {
+			bindings.prev.set(string(ast.next.val.symbol), g)
+			return blank_value(), nil
+		} else {
+			return blank_value(), e0
+		}
+	} else {
+		return blank_value(), errors.New("usage: (define my-symbol value)")
+	}
+}
+
+// defclass classes. cpl is the class precedence list: the class itself,
+// then its superclasses from most to least specific. slots are all the
+// slots an instance has, its own first, then inherited ones
+type class struct {
+	name   string
+	supers []*class
+	cpl    []*class
+	slots  []slot_spec
+}
+
+type slot_spec struct {
+	name     string
+	initform *tree
+}
+
+type object struct {
+	class *class
+	mu    sync.RWMutex
+	slots map[string]value
+}
+
+var classes = make(map[string]*class)
+var classes_mu sync.RWMutex
+
+func find_class(name string) *class {
+	classes_mu.RLock()
+	defer classes_mu.RUnlock()
+	return classes[name]
+}
+
+// linearize walks the superclasses depth first, left to right, and keeps
+// only the last time a class turns up, so a shared superclass comes after
+// everything that inherits from it
+func linearize(c *class) []*class {
+	walk := make([]*class, 0)
+	var visit func(k *class)
+	visit = func(k *class) {
+		walk = append(walk, k)
+		for _, s := range k.supers {
+			visit(s)
 		}
-		u = append(u, '"')
-		return u, nil
 	}
-	if v, e := eval2(ast.next, bindings); e == nil {
-		if v.valtype == t_symbol || v.valtype == t_head_symbol {
-			if symisstring(v.symbol) {
-				//g := ret+v.symbol
-				//ret = make([]rune, len(v.symbol)+len(ret))
-				for _, r := range stringify(v.symbol) {
-					ret = append(ret, r)
-				}
-				return cat(ast.next, bindings, ret)
-			} else {
-				return ret, errors.New("error: first argument to strlen must be a symbol starting and ending with double quotes")
+	visit(c)
+	cpl := make([]*class, 0)
+	for i, k := range walk {
+		later := false
+		for _, l := range walk[i+1:] {
+			if l == k {
+				later = true
+				break
 			}
-		} else {
-			return ret, errors.New("error: first argument to strlen must be a symbol")
 		}
-	} else {
-		return ret, e
+		if !later {
+			cpl = append(cpl, k)
+		}
 	}
+	return cpl
 }
 
-func strcatfunc(ast *tree, bindings *env) (value, error) {
-	if ast.next == nil || ast.next.next == nil {
-		return blank_value(), errors.New("usage: (strcat \"str1\" \"str2\"[ \"str3\" ...])")
-	}
-	if result, e := cat(ast, bindings, make([]rune, 0)); e == nil {
-		//fmt.Println(string(result))
-		return value_symbol_init(result), nil
-	} else {
-		return blank_value(), e
+// type_precedence is what a generic function dispatches on: the names
+// of every type v belongs to, most specific first, always ending in t.
+// Builtin types have a small hierarchy of their own
+func type_precedence(v value) []string {
+	switch v.valtype {
+	case t_object:
+		names := make([]string, 0)
+		for _, k := range v.object().class.cpl {
+			names = append(names, k.name)
+		}
+		return append(names, "object", "t")
+	case t_record:
+		return []string{v.record().rtype.name, "record", "t"}
+	case t_number_int, t_number_float, t_number_rat:
+		return []string{type_name(v), "number", "t"}
+	case t_tree:
+		return []string{"list", "tree", "t"}
+	case t_function, t_primitive:
+		return []string{type_name(v), "procedure", "t"}
 	}
-	return blank_value(), nil
+	return []string{type_name(v), "t"}
 }
 
-func intfunc(ast *tree, bindings *env) (value, error) {
-	if ast.next == nil {
-		return blank_value(), errors.New("usage: (int value)")
+func defclassfunc(ast *tree, bindings *env) (value, error) {
+	/* (defclass name (super ...) (slot (slot :initform expr :accessor name) ...)) */
+	usage := errors.New("usage: (defclass name (superclass ...) (slot ...))")
+	if ast.next == nil || ast.next.next == nil || ast.next.next.next == nil {
+		return blank_value(), usage
 	}
-	if v, e := eval2(ast.next, bindings); e == nil {
-		switch v.valtype {
-		case t_symbol:
-			if symisstring(v.symbol) {
-				if len(stringify(v.symbol)) == 1 {
-					return value_number_int_init(int64(stringify(v.symbol)[0])), nil
-				}
+	name := ast.next.val
+	if !is_symbol(name) || ast.next.next.val.valtype != t_tree || ast.next.next.next.val.valtype != t_tree {
+		return blank_value(), usage
+	}
+	c := &class{string(name.symbol), make([]*class, 0), nil, make([]slot_spec, 0)}
+	for _, s := range tree_values(ast.next.next.val.ast) {
+		if sym_is(s, "") {
+			continue
+		}
+		super := find_class(string(s.symbol))
+		if !is_symbol(s) || super == nil {
+			return blank_value(), new_error("type-error", "defclass %s: %s isn't a class", c.name, value_string(s))
+		}
+		c.supers = append(c.supers, super)
+	}
+	c.cpl = linearize(c)
+	accessors := make(map[string]value)
+	for sn := ast.next.next.next.val.ast; sn != nil; sn = sn.next {
+		spec := []value{sn.val}
+		if sn.val.valtype == t_tree {
+			spec = tree_values(sn.val.ast)
+		}
+		if sym_is(spec[0], "") && sn == ast.next.next.next.val.ast && sn.next == nil {
+			break
+		}
+		if !is_symbol(spec[0]) || len(spec)%2 != 1 {
+			return blank_value(), errors.New("error: defclass slot must look like name or (name :initform expr :accessor name)")
+		}
+		slot := slot_spec{string(spec[0].symbol), nil}
+		opts := sn.val.ast
+		if sn.val.valtype == t_tree {
+			opts = opts.next
+		} else {
+			opts = nil
+		}
+		for ; opts != nil; opts = opts.next.next {
+			switch {
+			case sym_is(opts.val, ":initform"):
+				slot.initform = opts.next
+			case sym_is(opts.val, ":accessor") && is_symbol(opts.next.val):
+				accessor := string(opts.next.val.symbol)
+				slot_name := slot.name
+				accessors[accessor] = value_primitive_init(accessor, func(args []value, b *env) (value, error) {
+					if len(args) != 1 {
+						return blank_value(), errors.New(fmt.Sprintf("usage: (%s object)", accessor))
+					}
+					return slot_value(args[0], slot_name, accessor)
+				})
+			default:
+				return blank_value(), errors.New(fmt.Sprintf("error: defclass %s: unknown slot option %s", c.name, value_string(opts.val)))
 			}
 		}
+		c.slots = append(c.slots, slot)
 	}
-	return blank_value(), nil
-}
-
-func collect_bools(ast *tree, bindings *env, ret []bool) ([]bool, error) {
-	if v, e0 := eval2(ast, bindings); e0 == nil {
-		if b, e := istrue(v, bindings); e == nil {
-			if ast.next != nil {
-				return collect_bools(ast.next, bindings, append(ret, b))
-			} else {
-				return append(ret, b), nil
+	/* inherited slots come after the class's own, each name only once */
+	seen := make(map[string]bool)
+	for _, s := range c.slots {
+		seen[s.name] = true
+	}
+	for _, k := range c.cpl[1:] {
+		for _, s := range k.slots {
+			if !seen[s.name] {
+				seen[s.name] = true
+				c.slots = append(c.slots, s)
 			}
-		} else {
-			return nil, e
 		}
-	} else {
-		return nil, e0
 	}
+	classes_mu.Lock()
+	classes[c.name] = c
+	classes_mu.Unlock()
+	bindings.set_all(accessors)
+	return name, nil
 }
 
-func nandfunc(ast *tree, bindings *env) (value, error) {
-	fmt.Println("nanding")
-	print_tree(ast)
-	if ast.next == nil || ast.next.next == nil {
-		return blank_value(), errors.New("usage: (nand bool1 bool2[ bool3 bool4 ...])")
+func slot_value(v value, slot string, form string) (value, error) {
+	if v.valtype != t_object {
+		return blank_value(), new_error("type-error", "%s expects an object, given %s", form, type_name(v))
 	}
-	if bs, e := collect_bools(ast.next, bindings, make([]bool, 0)); e == nil {
-		fmt.Println(bs)
-		for _, b := range bs {
-			if !b {
+	v.object().mu.RLock()
+	defer v.object().mu.RUnlock()
+	x, ok := v.object().slots[slot]
+	if !ok {
+		return blank_value(), new_error("unbound-slot", "%s has no slot %s", v.object().class.name, slot)
+	}
+	return x, nil
+}
+
+/* slot names in make-instance may be written x or :x */
+func slot_name(v value) string {
+	return strings.TrimPrefix(string(v.symbol), ":")
+}
+
+func objectfunc(ast *tree, bindings *env, form string) (value, error) {
+	args, e := get_subjects(ast.next, make([]value, 0), bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	switch form {
+	case "make-instance":
+		/* (make-instance 'class :slot value ...) */
+		if len(args) == 0 || len(args)%2 != 1 || !is_symbol(args[0]) {
+			return blank_value(), errors.New("usage: (make-instance 'class[ :slot value ...])")
+		}
+		c := find_class(string(args[0].symbol))
+		if c == nil {
+			return blank_value(), new_error("type-error", "make-instance: %s isn't a class", value_string(args[0]))
+		}
+		o := &object{class: c, slots: make(map[string]value)}
+		given := make(map[string]value)
+		for i := 1; i < len(args); i += 2 {
+			given[slot_name(args[i])] = args[i+1]
+		}
+		for _, s := range c.slots {
+			if v, ok := given[s.name]; ok {
+				o.slots[s.name] = v
+				delete(given, s.name)
+			} else if s.initform != nil {
+				v, e1 := eval2(s.initform, bindings)
+				if e1 != nil {
+					return blank_value(), e1
+				}
+				o.slots[s.name] = v
+			}
+		}
+		for name := range given {
+			return blank_value(), new_error("type-error", "make-instance: %s has no slot %s", c.name, name)
+		}
+		return value_object_init(o), nil
+	case "slot-value":
+		if len(args) != 2 || !is_symbol(args[1]) {
+			return blank_value(), errors.New("usage: (slot-value object 'slot)")
+		}
+		return slot_value(args[0], slot_name(args[1]), form)
+	case "set-slot-value!":
+		if len(args) != 3 || !is_symbol(args[1]) {
+			return blank_value(), errors.New("usage: (set-slot-value! object 'slot value)")
+		}
+		if args[0].valtype != t_object {
+			return blank_value(), new_error("type-error", "set-slot-value! expects an object, given %s", type_name(args[0]))
+		}
+		o := args[0].object()
+		name := slot_name(args[1])
+		known := false
+		for _, s := range o.class.slots {
+			known = known || s.name == name
+		}
+		if !known {
+			return blank_value(), new_error("unbound-slot", "%s has no slot %s", o.class.name, name)
+		}
+		o.mu.Lock()
+		o.slots[name] = args[2]
+		o.mu.Unlock()
+		return args[2], nil
+	case "class-of":
+		if len(args) != 1 {
+			return blank_value(), errors.New("usage: (class-of value)")
+		}
+		return value_symbol_init([]rune(type_precedence(args[0])[0])), nil
+	case "is-a?":
+		/* (is-a? x 'class) */
+		if len(args) != 2 || !is_symbol(args[1]) {
+			return blank_value(), errors.New("usage: (is-a? value 'class)")
+		}
+		for _, name := range type_precedence(args[0]) {
+			if name == string(args[1].symbol) {
 				return truesym(), nil
 			}
 		}
 		return falsesym(), nil
-	} else {
-		return falsesym(), e
 	}
+	return blank_value(), errors.New(fmt.Sprintf("error: unknown object operation %s", form))
 }
 
-func vals2list(vs []value, i int, target *tree) {
-	target.val = vs[i]
-	if i != len(vs)-1 {
-		target.next = &tree{blank_value(), true, nil, nil}
-		vals2list(vs, i+1, target.next)
-	}
+// a generic function is a set of methods; calling it runs the ones whose
+// specializers fit the arguments, combined the standard way: every :before
+// method, most specific first, then the most specific primary method,
+// which can pass control to the next with call-next-method, then every
+// :after method, least specific first. The primary's value is the result
+type generic struct {
+	name    string
+	arity   int
+	mu      sync.RWMutex
+	methods []*method
 }
 
-func applyeach(fn value, l *tree, b *env, acc []value) ([]value, error) {
-	print_value(l.val)
-	print_tree(&tree{value_ast_init(&tree{fn, true, &tree{l.val, true, nil, nil}, nil}), true, nil, nil})
-	if r, e := eval2(&tree{value_ast_init(&tree{fn, true, &tree{l.val, true, nil, nil}, nil}), true, nil, nil}, b); e == nil {
-		//if r, e := eval2(&tree{fn, true, &tree{l.val, true, nil, nil}, nil}, b); e == nil {
-		print_value(r)
-		acc = append(acc, r)
-	} else {
-		return make([]value, 0), e
-	}
-	if l.next != nil {
-		return applyeach(fn, l.next, b, acc)
-	} else {
-		return acc, nil
+type method struct {
+	qualifier    string
+	specializers []string
+	params       []string
+	body         *tree
+}
+
+var generics = make(map[string]*generic)
+var generics_mu sync.Mutex
+
+// find_generic gives the generic function called name, making it, and
+// binding it in bindings, if there isn't one of that arity yet
+func find_generic(name string, arity int, bindings *env) *generic {
+	generics_mu.Lock()
+	defer generics_mu.Unlock()
+	g, ok := generics[name]
+	if !ok || g.arity != arity {
+		g = &generic{name: name, arity: arity}
+		generics[name] = g
+		bindings.set(name, value_primitive_init(name, func(args []value, b *env) (value, error) {
+			return g.call(args, b)
+		}))
 	}
+	return g
 }
 
-func dofor(ast *tree, bindings *env) (value, error) {
-	if ast.next != nil && ast.next.next != nil {
-		if fn, ev := eval2(ast.next, bindings); ev == nil {
-			print_value(fn)
-			if v, e0 := eval2(ast.next.next, bindings); e0 == nil {
-				if v.valtype == t_tree {
-					vals, e1 := applyeach(fn, v.ast.val.ast, bindings, make([]value, 0))
-					if e1 == nil {
-						x := tree{blank_value(), true, nil, nil}
-						vals2list(vals, 0, &x)
-						return value_ast_init(&tree{value_ast_init(&x), true, nil, nil}), nil
-					} else {
-						return blank_value(), e1
-					}
-				} else {
-					return blank_value(), errors.New("error: second argument to dofor must be list")
+func (g *generic) call(args []value, bindings *env) (value, error) {
+	if len(args) != g.arity {
+		return blank_value(), errors.New(fmt.Sprintf("error: %s takes %d arguments, given %d", g.name, g.arity, len(args)))
+	}
+	precedence := make([][]string, len(args))
+	for i, a := range args {
+		precedence[i] = type_precedence(a)
+	}
+	/* rank[i] is where each argument's specializer falls in that
+	argument's precedence list, or -1 if it doesn't apply */
+	rank := func(m *method) []int {
+		r := make([]int, len(args))
+		for i, s := range m.specializers {
+			r[i] = -1
+			for j, name := range precedence[i] {
+				if name == s {
+					r[i] = j
+					break
 				}
-			} else {
-				return blank_value(), e0
 			}
-		} else {
-			return blank_value(), ev
+			if r[i] < 0 {
+				return nil
+			}
+		}
+		return r
+	}
+	type ranked struct {
+		m *method
+		r []int
+	}
+	applicable := make([]ranked, 0)
+	g.mu.RLock()
+	for _, m := range g.methods {
+		if r := rank(m); r != nil {
+			applicable = append(applicable, ranked{m, r})
+		}
+	}
+	g.mu.RUnlock()
+	/* most specific first, comparing the arguments left to right */
+	sort.SliceStable(applicable, func(a, b int) bool {
+		for i := range applicable[a].r {
+			if applicable[a].r[i] != applicable[b].r[i] {
+				return applicable[a].r[i] < applicable[b].r[i]
+			}
+		}
+		return false
+	})
+	befores, primaries, afters := make([]*method, 0), make([]*method, 0), make([]*method, 0)
+	for _, a := range applicable {
+		switch a.m.qualifier {
+		case ":before":
+			befores = append(befores, a.m)
+		case ":after":
+			afters = append([]*method{a.m}, afters...)
+		default:
+			primaries = append(primaries, a.m)
+		}
+	}
+	if len(primaries) == 0 {
+		names := make([]string, len(args))
+		for i, a := range args {
+			names[i] = type_name(a)
+		}
+		return blank_value(), new_error("no-applicable-method", "no method of %s applies to (%s)", g.name, strings.Join(names, " "))
+	}
+	for _, m := range befores {
+		if _, e := m.run(args, nil, bindings); e != nil {
+			return blank_value(), e
+		}
+	}
+	r, e := primaries[0].run(args, primaries[1:], bindings)
+	if e != nil {
+		return blank_value(), e
+	}
+	for _, m := range afters {
+		if _, e1 := m.run(args, nil, bindings); e1 != nil {
+			return blank_value(), e1
 		}
-	} else {
-		return blank_value(), errors.New("usage: (dofor fn (list x[ y z ...]))")
 	}
+	return r, nil
 }
 
-func definefunc(ast *tree, bindings *env) (value, error) {
-	if ast.next != nil && ast.next.next != nil {
-		if ast.next.val.valtype != t_symbol {
-			return blank_value(), errors.New(fmt.Sprintf("error: define can't bind to a non-symbol (%s)", typenames[ast.next.val.valtype]))
+// run calls the method on args. next is the chain of less specific
+// primary methods that call-next-method works through
+func (m *method) run(args []value, next []*method, bindings *env) (value, error) {
+	local := new_env(make(map[string]value), bindings)
+	for i, p := range m.params {
+		local.set(p, args[i])
+	}
+	local.set("next-method-p", value_primitive_init("next-method-p", func(a []value, b *env) (value, error) {
+		if len(next) > 0 {
+			return truesym(), nil
 		}
-		if g, e0 := eval2(ast.next.next, bindings); e0 == nil {
-			bindings.prev.values[string(ast.next.val.symbol)] = g
-			return blank_value(), nil
-		} else {
-			return blank_value(), e0
+		return falsesym(), nil
+	}))
+	local.set("call-next-method", value_primitive_init("call-next-method", func(a []value, b *env) (value, error) {
+		/* with no arguments, the next method gets the same ones */
+		if len(a) == 0 {
+			a = args
 		}
-	} else {
-		return blank_value(), errors.New("usage: (define my-symbol value)")
+		if len(next) == 0 {
+			return blank_value(), new_error("no-applicable-method", "there is no next method")
+		}
+		return next[0].run(a, next[1:], bindings)
+	}))
+	return prognfunc(m.body, local)
+}
+
+func defgenericfunc(ast *tree, bindings *env) (value, error) {
+	/* (defgeneric name (arg ...)) */
+	if ast.next == nil || !is_symbol(ast.next.val) || ast.next.next == nil || ast.next.next.val.valtype != t_tree {
+		return blank_value(), errors.New("usage: (defgeneric name (arg ...))")
+	}
+	params := tree_values(ast.next.next.val.ast)
+	if len(params) == 1 && sym_is(params[0], "") {
+		params = params[:0]
+	}
+	find_generic(string(ast.next.val.symbol), len(params), bindings)
+	return ast.next.val, nil
+}
+
+func defmethodfunc(ast *tree, bindings *env) (value, error) {
+	/* (defmethod name [:before|:after] ((arg class) arg ...) body ...) */
+	usage := errors.New("usage: (defmethod name [:before|:after] ((arg class) arg ...) body ...)")
+	if ast.next == nil || !is_symbol(ast.next.val) || ast.next.next == nil {
+		return blank_value(), usage
+	}
+	m := &method{"", make([]string, 0), make([]string, 0), nil}
+	rest := ast.next.next
+	if sym_is(rest.val, ":before") || sym_is(rest.val, ":after") {
+		m.qualifier = string(rest.val.symbol)
+		rest = rest.next
+	}
+	if rest == nil || rest.val.valtype != t_tree || rest.next == nil {
+		return blank_value(), usage
 	}
+	for _, p := range tree_values(rest.val.ast) {
+		if sym_is(p, "") {
+			continue
+		}
+		if is_symbol(p) {
+			m.params = append(m.params, string(p.symbol))
+			m.specializers = append(m.specializers, "t")
+			continue
+		}
+		ps := tree_values(p.ast)
+		if p.valtype != t_tree || len(ps) != 2 || !is_symbol(ps[0]) || !is_symbol(ps[1]) {
+			return blank_value(), usage
+		}
+		m.params = append(m.params, string(ps[0].symbol))
+		m.specializers = append(m.specializers, string(ps[1].symbol))
+	}
+	m.body = rest.next
+	name := string(ast.next.val.symbol)
+	g := find_generic(name, len(m.params), bindings)
+	/* a method with the same qualifier and specializers replaces the old one */
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, old := range g.methods {
+		if old.qualifier == m.qualifier && strings.Join(old.specializers, " ") == strings.Join(m.specializers, " ") {
+			g.methods[i] = m
+			return ast.next.val, nil
+		}
+	}
+	g.methods = append(g.methods, m)
+	return ast.next.val, nil
 }
 
 func funcdex(symbol []rune, ast *tree, bindings *env) (value, error) {
@@ -1266,7 +7526,7 @@ func funcdex(symbol []rune, ast *tree, bindings *env) (value, error) {
 	case "quit", "exit":
 		os.Exit(0)
 	case "define":
-		return definefunc(ast, &env{make(map[string]value), bindings})
+		return definefunc(ast, new_env(make(map[string]value), bindings))
 	case "quote":
 		//fmt.Println("doing quote")
 		return quotefunc(ast, bindings)
@@ -1300,7 +7560,7 @@ func funcdex(symbol []rune, ast *tree, bindings *env) (value, error) {
 	case "cadr":
 		return cadrfunc(ast, bindings)
 	case "let":
-		v, e := letfunc(ast, &env{make(map[string]value), bindings})
+		v, e := letfunc(ast, new_env(make(map[string]value), bindings))
 		return v, e
 	case "progn":
 		/* progn has to be like this because we call it instead of eval
@@ -1326,7 +7586,7 @@ func funcdex(symbol []rune, ast *tree, bindings *env) (value, error) {
 		return prependfunc(ast, bindings)
 	case "strlen":
 		return strlenfunc(ast, bindings)
-	case "strindex":
+	case "strindex", "string-ref":
 		return strindexfunc(ast, bindings)
 	case "strcat":
 		return strcatfunc(ast, bindings)
@@ -1334,6 +7594,128 @@ func funcdex(symbol []rune, ast *tree, bindings *env) (value, error) {
 		return intfunc(ast, bindings)
 	case "nand":
 		return nandfunc(ast, bindings)
+	case "set!":
+		return setfunc(ast, bindings)
+	case "<", ">", "<=", ">=":
+		return numcmpfunc(ast, bindings, sym)
+	case "while":
+		return whilefunc(ast, bindings)
+	case "dotimes":
+		return dotimesfunc(ast, bindings)
+	case "dolist":
+		return dolistfunc(ast, bindings)
+	case "do":
+		return dofunc(ast, bindings)
+	case "for", "for/list", "for/sum", "for/product", "for/and", "for/or", "for/fold",
+		"for*", "for*/list", "for*/sum", "for*/product", "for*/and", "for*/or", "for*/fold":
+		return forfunc(ast, bindings, sym)
+	case "match":
+		return matchfunc(ast, bindings)
+	case "destructuring-bind":
+		return destructuringbindfunc(ast, bindings)
+	case "error":
+		return errorfunc(ast, bindings)
+	case "raise":
+		return raisefunc(ast, bindings)
+	case "error-object?", "error-object-message", "error-object-kind", "error-object-irritants",
+		"error-object-location", "error-object-trace":
+		return errorobjfunc(ast, bindings, sym)
+	case "try", "unwind-protect":
+		return tryfunc(ast, bindings, sym)
+	case "spawn":
+		return spawnfunc(ast, bindings)
+	case "join":
+		return joinfunc(ast, bindings)
+	case "receive!":
+		return mailboxreceivefunc(ast, bindings)
+	case "make-channel", "send", "receive", "close", "eof-object?":
+		return channelfunc(ast, bindings, sym)
+	case "select":
+		return selectfunc(ast, bindings)
+	case "atom", "reset!", "swap!", "compare-and-set!":
+		return atomfunc(ast, bindings, sym)
+	case "ref", "deref", "ref-set", "alter":
+		return reffunc(ast, bindings, sym)
+	case "dosync":
+		return dosyncfunc(ast, bindings)
+	case "after", "every", "cancel-timer", "sleep", "on-receive", "stop-event-loop":
+		return timerfunc(ast, bindings, sym)
+	case "run-event-loop":
+		return runeventloopfunc(ast, bindings)
+	case "spawn-actor", "self", "send!", "link", "monitor":
+		return actorfunc(ast, bindings, sym)
+	case "delay", "lazy-cons", "force", "make-promise", "promise?":
+		return promisefunc(ast, bindings, sym)
+	case "stream-car", "stream-cdr", "stream-null?", "stream-map", "stream-filter", "stream-take":
+		return streamfunc(ast, bindings, sym)
+	case "make-generator", "yield", "next", "generator->stream":
+		return generatorfunc(ast, bindings, sym)
+	case "make-hash", "hash", "hash?", "hash-ref", "hash-set!", "hash-update!", "hash-remove!", "hash-has-key?",
+		"hash-count", "hash-keys", "hash-values", "hash->list", "hash-for-each", "hash-map":
+		return hashfunc(ast, bindings, sym)
+	case "vector", "make-vector", "list->vector", "vector?", "vector-map", "vector-for-each",
+		"vector-length", "vector-ref", "vector-set!", "vector->list", "vector-slice":
+		return vectorfunc(ast, bindings, sym)
+	case "persistent-map", "persistent-vector", "persistent-map?", "persistent-vector?",
+		"assoc", "dissoc", "conj", "get", "update", "contains?":
+		return persistentfunc(ast, bindings, sym)
+	case "define-record-type":
+		return definerecordtypefunc(ast, bindings)
+	case "type-of":
+		return typeoffunc(ast, bindings)
+	case "string?", "substring", "string-split", "string-join", "string-trim", "string-upcase", "string-downcase",
+		"string-contains", "string-index-of", "string-replace", "string-prefix?", "string-suffix?",
+		"string->list", "list->string", "string->number", "number->string",
+		"string=?", "string<?", "string>?", "string<=?", "string>=?":
+		return stringfunc(ast, bindings, sym)
+	case "format", "printf":
+		return formatfunc(ast, bindings, sym)
+	case "regexp", "regexp?", "regexp-match", "regexp-match-all", "regexp-replace", "regexp-split":
+		return regexpfunc(ast, bindings, sym)
+	case "char?", "char->integer", "integer->char", "char-upcase", "char-downcase", "char->string",
+		"char-alphabetic?", "char-numeric?", "char-whitespace?", "char-upper-case?", "char-lower-case?",
+		"char=?", "char<?", "char>?", "char<=?", "char>=?":
+		return charfunc(ast, bindings, sym)
+	case "symbol?", "symbol->string", "string->symbol", "gensym", "keyword?", "keyword->string", "string->keyword":
+		return symbolfunc(ast, bindings, sym)
+	case "defclass":
+		return defclassfunc(ast, bindings)
+	case "make-instance", "slot-value", "set-slot-value!", "class-of", "is-a?":
+		return objectfunc(ast, bindings, sym)
+	case "defgeneric":
+		return defgenericfunc(ast, bindings)
+	case "defmethod":
+		return defmethodfunc(ast, bindings)
+	case "equal?":
+		args, e := get_subjects(ast.next, make([]value, 0), bindings)
+		if e != nil {
+			return blank_value(), e
+		}
+		if len(args) != 2 {
+			return blank_value(), errors.New("usage: (equal? value1 value2)")
+		}
+		if same_value(args[0], args[1], bindings) {
+			return truesym(), nil
+		}
+		return falsesym(), nil
+	case "pmap", "pfor-each":
+		return pmapfunc(ast, bindings, sym)
+	case "call/ec", "call/cc", "call-with-current-continuation", "call-with-escape-continuation", "let/ec":
+		return callecfunc(ast, bindings, sym)
+	case "signal", "warn", "make-condition":
+		return signalfunc(ast, bindings, sym)
+	case "handler-bind":
+		return handlerbindfunc(ast, bindings)
+	case "handler-case":
+		return handlercasefunc(ast, bindings)
+	case "restart-case":
+		return restartcasefunc(ast, bindings)
+	case "invoke-restart":
+		return invokerestartfunc(ast, bindings)
+	case "compute-restarts", "find-restart":
+		return restartqueryfunc(ast, bindings, sym)
+	case "define-condition-type", "condition-is-a?":
+		return conditiontypefunc(ast, bindings, sym)
 	default:
 		fmt.Println("GUNVGUN")
 		fmt.Println("looking for ", string(ast.val.symbol))
@@ -1369,7 +7751,33 @@ func quoted_sym(sym []rune) (bool, []rune) {
 	}
 }
 
+// eval2 evaluates one node. If that fails, the error is pinned to this
+// node unless something more specific already has been, and if the node is
+// a call it adds itself to the error's stack on the way out
 func eval2(ast *tree, bindings *env) (value, error) {
+	v, err := eval_node(ast, bindings)
+	if err == nil || is_control(err) {
+		return v, err
+	}
+	re := as_radu_error(err)
+	if ast.val.pos.line == 0 {
+		// made up by the interpreter rather than read from source
+		return v, re
+	}
+	if re.form == nil {
+		re.form = ast
+	}
+	if ast.val.valtype == t_tree && ast.val.ast != nil && len(ast.val.decorations) == 0 {
+		name := "lambda"
+		if is_symbol(ast.val.ast.val) {
+			name = string(ast.val.ast.val.symbol)
+		}
+		re.trace = append(re.trace, frame{name, ast.val.pos})
+	}
+	return v, re
+}
+
+func eval_node(ast *tree, bindings *env) (value, error) {
 	/*
 						1. ast = (fn arg1 arg2 arg3 ...) => call fnfunc() with ast
 							2. ((fn arg1 arg2 arg3 ...) ext1 ext2 ext3) => evaluate ast.next then if ast.next is a lambda then performfunc, else fnfunc() lookup
@@ -1404,13 +7812,16 @@ func eval2(ast *tree, bindings *env) (value, error) {
 						if af.valtype == t_function {
 							// a lambda
 							fmt.Println("lambdaing")
-							y, u := performfunc(af, &env{make(map[string]value, 0), bindings}, ast.val.ast.next)
+							y, u := performfunc(af, new_env(make(map[string]value), bindings), ast.val.ast.next)
 							return y, u
 						}
 						if af.valtype == t_symbol {
 							// a symbol
 							return funcdex(af.symbol, ast.val.ast, bindings)
 						}
+						if af.valtype == t_primitive {
+							return performprim(af, bindings, ast.val.ast.next)
+						}
 					} else {
 						return blank_value(), e
 					}
@@ -1418,14 +7829,25 @@ func eval2(ast *tree, bindings *env) (value, error) {
 
 				if ast.val.ast.val.valtype == t_function {
 					fmt.Println("got a tree")
-					y, u := performfunc(ast.val.ast.val, &env{make(map[string]value, 0), bindings}, ast.val.ast.next)
+					y, u := performfunc(ast.val.ast.val, new_env(make(map[string]value), bindings), ast.val.ast.next)
 					return y, u
 				}
+
+				if ast.val.ast.val.valtype == t_primitive {
+					return performprim(ast.val.ast.val, bindings, ast.val.ast.next)
+				}
 			} else {
+				if string(ast.val.decorations) == "#hash" {
+					return hash_literal(ast.val)
+				}
+				if string(ast.val.decorations) == "#" {
+					return vector_literal(ast.val), nil
+				}
 				// case 11
 				if ast.val.decorations[0] == '\'' {
-					ast.val.decorations = ast.val.decorations[1:]
-					return quotefunc(&tree{value_symbol_init([]rune("quote")), true, ast.val.ast, nil}, bindings)
+					q := ast.val
+					q.decorations = q.decorations[1:]
+					return quotefunc(&tree{value_symbol_init([]rune("quote")), true, &tree{q, true, nil, nil}, nil}, bindings)
 				}
 
 			}
@@ -1442,12 +7864,25 @@ func eval2(ast *tree, bindings *env) (value, error) {
 		//print_value(ast.val)
 		if len(ast.val.decorations) > 0 && ast.val.decorations[0] == '\'' {
 			//fmt.Println("ff")
-			ast.val.decorations = ast.val.decorations[1:]
-			return quotefunc(&tree{value_symbol_init([]rune("quote")), true, &tree{ast.val, true, nil, nil}, nil}, bindings)
+			/* strip the quote from a copy; the source tree may be evaluated again */
+			q := ast.val
+			q.decorations = q.decorations[1:]
+			return quotefunc(&tree{value_symbol_init([]rune("quote")), true, &tree{q, true, nil, nil}, nil}, bindings)
+		}
+		/* @x is short for (deref x) */
+		if len(ast.val.decorations) > 0 && ast.val.decorations[0] == '@' {
+			q := ast.val
+			q.decorations = q.decorations[1:]
+			return reffunc(&tree{value_symbol_init([]rune("deref")), true, &tree{q, true, nil, nil}, nil}, bindings, "deref")
 		}
 
 		rsym := ast.val.symbol
 
+		// strings evaluate to themselves
+		if symisstring(rsym) {
+			return ast.val, nil
+		}
+
 		// case 12
 		if len(rsym) == 1 && rsym[0] == '-' {
 			return ast.val, nil
@@ -1475,6 +7910,16 @@ func eval2(ast *tree, bindings *env) (value, error) {
 		// case 6 & 9
 		// tbd
 
+		if is_keyword(ast.val) {
+			return value_symbol_init(rsym), nil
+		}
+		if is_char_literal(rsym) {
+			return char_literal(rsym)
+		}
+		if is_regexp_literal(rsym) {
+			return regexp_literal(rsym)
+		}
+
 		// case 10
 		if res, finderr := bound(ast.val.symbol, bindings); finderr == nil {
 			return res, nil
@@ -1649,38 +8094,178 @@ func eval2(ast *tree, bindings *env) (value, error) {
 }*/
 
 func print_value(v value) {
-	fmt.Printf("%s", string(v.decorations))
+	fprint_value(os.Stdout, v)
+}
+
+// value_string renders v the same way print_value would, for use in
+// error messages
+func value_string(v value) string {
+	var b strings.Builder
+	fprint_value(&b, v)
+	return b.String()
+}
+
+func fprint_value(w io.Writer, v value) {
+	fmt.Fprintf(w, "%s", string(v.decorations))
 	switch v.valtype {
 	case t_symbol, t_head_symbol:
-		fmt.Printf(string(v.symbol))
+		fmt.Fprint(w, string(v.symbol))
+	case t_char:
+		fmt.Fprint(w, char_string(v.symbol[0]))
+	case t_regexp:
+		fmt.Fprintf(w, "#rx\"%s\"", v.rx().String())
 	case t_tree:
-		print_tree(v.ast)
+		fprint_tree(w, v.ast)
 	case t_number_float:
-		fmt.Printf("%f", v.number.floatval)
+		fmt.Fprintf(w, "%f", v.number.floatval)
 	case t_number_int:
-		fmt.Printf("%d", v.number.intval)
+		fmt.Fprintf(w, "%d", v.number.intval)
+	case t_error:
+		fmt.Fprintf(w, "#<%s", string(v.err().kind))
+		fmt.Fprintf(w, ": %s", v.err().message)
+		for _, i := range v.err().irritants {
+			fmt.Fprint(w, " ")
+			fprint_value(w, i)
+		}
+		fmt.Fprint(w, ">")
+	case t_primitive:
+		fmt.Fprintf(w, "#<%s>", v.prim().name)
+	case t_task:
+		fmt.Fprint(w, "#<task>")
+	case t_channel:
+		fmt.Fprint(w, "#<channel>")
+	case t_eof:
+		fmt.Fprint(w, "#<eof>")
+	case t_timer:
+		fmt.Fprint(w, "#<timer>")
+	case t_pid:
+		fmt.Fprintf(w, "#<pid %d>", v.actor().id)
+	case t_promise:
+		fmt.Fprint(w, "#<promise>")
+	case t_generator:
+		fmt.Fprint(w, "#<generator>")
+	case t_vector:
+		fmt.Fprint(w, "#(")
+		for i, x := range v.vector().snapshot() {
+			if i > 0 {
+				fmt.Fprint(w, " ")
+			}
+			fprint_value(w, x)
+		}
+		fmt.Fprint(w, ")")
+	case t_object:
+		fmt.Fprintf(w, "#<%s", v.object().class.name)
+		v.object().mu.RLock()
+		slots := make([]value, len(v.object().class.slots))
+		set := make([]bool, len(slots))
+		for i, sl := range v.object().class.slots {
+			slots[i], set[i] = v.object().slots[sl.name]
+		}
+		v.object().mu.RUnlock()
+		for i, sl := range v.object().class.slots {
+			if set[i] {
+				fmt.Fprintf(w, " %s: ", sl.name)
+				fprint_value(w, slots[i])
+			}
+		}
+		fmt.Fprint(w, ">")
+	case t_record:
+		fmt.Fprintf(w, "#<%s", v.record().rtype.name)
+		for i, x := range v.record().snapshot() {
+			fmt.Fprintf(w, " %s: ", v.record().rtype.fields[i])
+			fprint_value(w, x)
+		}
+		fmt.Fprint(w, ">")
+	case t_pmap:
+		fmt.Fprint(w, "#<persistent-map")
+		for _, p := range v.pmap().pairs() {
+			kv, _ := list_values(p)
+			fmt.Fprint(w, " (")
+			fprint_value(w, kv[0])
+			fmt.Fprint(w, " . ")
+			fprint_value(w, kv[1])
+			fmt.Fprint(w, ")")
+		}
+		fmt.Fprint(w, ">")
+	case t_pvec:
+		fmt.Fprint(w, "#<persistent-vector")
+		for _, x := range v.pvec().items() {
+			fmt.Fprint(w, " ")
+			fprint_value(w, x)
+		}
+		fmt.Fprint(w, ">")
+	case t_hash:
+		fmt.Fprint(w, "#hash(")
+		for i, p := range v.hash().pairs() {
+			if i > 0 {
+				fmt.Fprint(w, " ")
+			}
+			fmt.Fprint(w, "(")
+			fprint_value(w, p.key)
+			fmt.Fprint(w, " . ")
+			fprint_value(w, p.val)
+			fmt.Fprint(w, ")")
+		}
+		fmt.Fprint(w, ")")
+	case t_atom:
+		v, _ := v.atom().load()
+		fmt.Fprint(w, "#<atom ")
+		fprint_value(w, v)
+		fmt.Fprint(w, ">")
+	case t_ref:
+		v, _ := v.ref().load()
+		fmt.Fprint(w, "#<ref ")
+		fprint_value(w, v)
+		fmt.Fprint(w, ">")
 	case t_function:
-		fmt.Printf("inputs: ")
+		fmt.Fprintf(w, "inputs: ")
 		for _, x := range v.function.args {
-			fmt.Printf(string(x) + ", ")
+			fmt.Fprint(w, string(x)+", ")
 		}
-		fmt.Printf("action: ")
-		print_tree(v.function.action)
+		fmt.Fprintf(w, "action: ")
+		fprint_tree(w, v.function.action)
+	}
+}
+
+// the repl and the restart debugger share one reader so neither loses
+// input the other has buffered
+var stdin = bufio.NewReader(os.Stdin)
+
+// set while the repl is running, so an unhandled error with restarts
+// available asks the user which one to take
+var interactive = false
+
+// describe_error gives the full report for a radu_error, with where it
+// happened and the stack, or just the message for anything else
+func describe_error(err error) string {
+	if re, ok := err.(*radu_error); ok {
+		return re.report()
 	}
+	return err.Error()
 }
 
+var repl_line = 0
+
 func repl(b *env) {
-	reader := bufio.NewReader(os.Stdin)
+	interactive = true
 	fmt.Printf("radu> ")
-	text, _ := reader.ReadString('\n')
-	my_tree := tree{value_symbol_init(make([]rune, 0)), false, nil, nil}
+	text, rerr := stdin.ReadString('\n')
+	if rerr != nil {
+		fmt.Println()
+		os.Exit(0)
+	}
+	repl_line++
 	program := text[:len(text)-1] // trim off the last character because it's a \n
-	parse([]rune(program), 0, &my_tree, make([]rune, 0), false)
-	r, err := prognfunc(&my_tree, b)
+	r, err := blank_value(), error(nil)
+	if prog, perr := read_program([]rune(program), "<stdin>", repl_line); perr != nil {
+		err = perr
+	} else {
+		r, err = prognfunc(prog, b)
+	}
 	if err == nil {
 		print_value(r)
 	} else {
-		fmt.Printf(err.Error())
+		fmt.Print(describe_error(err))
 	}
 
 	//print_tree(&my_tree)
@@ -1689,15 +8274,28 @@ func repl(b *env) {
 }
 
 func main() {
-	me := env{make(map[string]value), &env{make(map[string]value), nil}}
-	repl(&me)
+	me := new_env(make(map[string]value), new_env(make(map[string]value), nil))
+	if len(os.Args) > 1 {
+		/* radu script.rad runs a file instead of starting the repl */
+		src, rerr := os.ReadFile(os.Args[1])
+		if rerr != nil {
+			fmt.Fprintln(os.Stderr, rerr)
+			os.Exit(1)
+		}
+		if _, err := run_source(string(src), os.Args[1], me); err != nil {
+			fmt.Fprintln(os.Stderr, describe_error(err))
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	repl(me)
 	my_tree := tree{value_symbol_init(make([]rune, 0)), false, nil, nil}
 	program := "(len (list (list 1 4) 2 3 4 5 6 7))"
 	fmt.Println(program)
 	parse([]rune(program), 0, &my_tree, make([]rune, 0), false)
 	//print_tree(&my_tree)
 	fmt.Println("\nEval: ")
-	r, err := prognfunc(&my_tree, &env{make(map[string]value), nil})
+	r, err := prognfunc(&my_tree, new_env(make(map[string]value), nil))
 	if err == nil {
 		print_value(r)
 	} else {
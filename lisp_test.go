@@ -0,0 +1,366 @@
+package main
+
+import (
+	"os"
+	"sync"
+	"testing"
+)
+
+var quiet sync.Once
+
+// run evaluates src in bindings and gives back how the result prints.
+// The interpreter traces to stdout, so the first call points os.Stdout
+// at /dev/null for good; testing already holds its own handle on stdout
+// by then. It isn't put back, since tasks started by one call can still
+// be printing during the next.
+func run(t *testing.T, bindings *env, src string) string {
+	t.Helper()
+	quiet.Do(func() {
+		if null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+			os.Stdout = null
+		}
+	})
+	v, err := run_source(src, t.Name(), bindings)
+	if err != nil {
+		t.Fatalf("%s: %s", src, describe_error(err))
+	}
+	return value_string(v)
+}
+
+func new_test_env() *env {
+	return new_env(make(map[string]value), new_env(make(map[string]value), nil))
+}
+
+func expect(t *testing.T, bindings *env, src string, want string) {
+	t.Helper()
+	if got := run(t, bindings, src); got != want {
+		t.Errorf("%s gave %s, want %s", src, got, want)
+	}
+}
+
+func TestCompareAndSetReferenceValues(t *testing.T) {
+	b := new_test_env()
+	run(t, b, "(define h (make-hash)) (define a (atom h))")
+	expect(t, b, "(compare-and-set! a (make-hash) 1)", "#f")
+	expect(t, b, "(compare-and-set! a h 2)", "#t")
+	expect(t, b, "@a", "2")
+	run(t, b, "(define inner (atom 0)) (define outer (atom inner))")
+	expect(t, b, "(compare-and-set! outer (atom 0) 1)", "#f")
+	expect(t, b, "(compare-and-set! outer inner 1)", "#t")
+	expect(t, b, "@outer", "1")
+}
+
+func TestDosyncCountersUnderPforEach(t *testing.T) {
+	b := new_test_env()
+	run(t, b, `(define n (ref 0))
+(define sum (ref 0))
+(pfor-each (lambda (i) (dosync (alter n (lambda (x) (+ x 1))) (alter sum (lambda (x) (+ x i))))) 500)`)
+	expect(t, b, "@n", "500")
+	expect(t, b, "@sum", "124750")
+	/* a transfer between two refs never shows the total changing */
+	run(t, b, `(define from (ref 1000))
+(define to (ref 0))
+(define seen (atom 0))
+(pfor-each (lambda (i) (if (> i 99)
+	(dosync (if (eq 1000 (+ @from @to)) 0 (swap! seen (lambda (x) (+ x 1)))))
+	(dosync (alter from (lambda (x) (- x 10))) (alter to (lambda (x) (+ x 10)))))) 200)`)
+	expect(t, b, "@from", "0")
+	expect(t, b, "@to", "1000")
+	expect(t, b, "@seen", "0")
+}
+
+func TestHashUpdateUnderPforEach(t *testing.T) {
+	b := new_test_env()
+	run(t, b, `(define c (make-hash))
+(pfor-each (lambda (i) (hash-update! c (% i 3) (lambda (x) (+ x 1)) 0)) 3000 32)
+(pfor-each (lambda (i) (hash-update! c 'n (lambda (x) (+ x 1)) 0)) 2000 32)`)
+	expect(t, b, "(hash-ref c 'n)", "2000")
+	expect(t, b, "(hash-ref c 0)", "1000")
+	expect(t, b, "(hash-ref c 1)", "1000")
+	expect(t, b, "(hash-ref c 2)", "1000")
+}
+
+func int_value(i int) value {
+	return value_number_int_init(int64(i))
+}
+
+func TestPersistentMapAcrossLevels(t *testing.T) {
+	const n = 5000
+	m := &persistent_map{}
+	for i := 0; i < n; i++ {
+		m = m.assoc(int_value(i), int_value(i*i))
+	}
+	if m.count != n {
+		t.Fatalf("count is %d, want %d", m.count, n)
+	}
+	full := m
+	for i := 0; i < n; i += 2 {
+		m = m.dissoc(int_value(i))
+	}
+	if m.count != n/2 {
+		t.Fatalf("count after dissoc is %d, want %d", m.count, n/2)
+	}
+	for i := 0; i < n; i++ {
+		v, ok := m.get(int_value(i))
+		if ok != (i%2 == 1) || ok && v.number.intval != int64(i*i) {
+			t.Fatalf("get %d gave %s, %v", i, value_string(v), ok)
+		}
+		/* the version before the dissocs still has every key */
+		if v, ok := full.get(int_value(i)); !ok || v.number.intval != int64(i*i) {
+			t.Fatalf("old version lost %d", i)
+		}
+	}
+	if _, ok := m.get(int_value(n)); ok {
+		t.Fatalf("found a key that was never added")
+	}
+	for i := 1; i < n; i += 2 {
+		m = m.dissoc(int_value(i))
+	}
+	if m.count != 0 || m.root != nil {
+		t.Fatalf("map isn't empty after removing every key")
+	}
+}
+
+func TestPersistentMapCollisions(t *testing.T) {
+	/* "i116048" and "i1308084" have the same FNV-32a hash */
+	a, b := int_value(116048), int_value(1308084)
+	if key_hash(hash_key(a)) != key_hash(hash_key(b)) {
+		t.Fatalf("keys don't collide")
+	}
+	m := (&persistent_map{}).assoc(a, int_value(1)).assoc(b, int_value(2))
+	if va, _ := m.get(a); va.number.intval != 1 {
+		t.Fatalf("get a gave %s", value_string(va))
+	}
+	if vb, _ := m.get(b); vb.number.intval != 2 {
+		t.Fatalf("get b gave %s", value_string(vb))
+	}
+	without := m.dissoc(a)
+	if _, ok := without.get(a); ok || without.count != 1 {
+		t.Fatalf("dissoc of a colliding key didn't remove it")
+	}
+	if vb, ok := without.get(b); !ok || vb.number.intval != 2 {
+		t.Fatalf("dissoc of a colliding key removed the other one")
+	}
+	if _, ok := m.get(a); !ok {
+		t.Fatalf("dissoc changed the old version")
+	}
+}
+
+func TestPersistentMapSharing(t *testing.T) {
+	m := &persistent_map{}
+	for i := 0; i < 2000; i++ {
+		m = m.assoc(int_value(i), int_value(i))
+	}
+	m2 := m.assoc(int_value(7), value_symbol_init([]rune("seven")))
+	if v, _ := m.get(int_value(7)); v.number.intval != 7 {
+		t.Fatalf("assoc changed the old version")
+	}
+	if v, _ := m2.get(int_value(7)); value_string(v) != "seven" {
+		t.Fatalf("assoc didn't change the new version")
+	}
+	/* only the branch on the path to the changed key is copied */
+	if len(m.root.children) != len(m2.root.children) {
+		t.Fatalf("root changed shape")
+	}
+	copied := 0
+	for i := range m.root.children {
+		if m.root.children[i] != m2.root.children[i] {
+			copied++
+		}
+	}
+	if copied != 1 {
+		t.Fatalf("%d of the root's children were copied, want 1", copied)
+	}
+}
+
+func TestPersistentVectorAcrossLevels(t *testing.T) {
+	/* the tail holds 32 items, and the trie's root gets another level
+	above 1024, then 32768 items */
+	const n = 40000
+	v := empty_pvec
+	for i := 0; i < n; i++ {
+		v = v.conj(int_value(i))
+	}
+	if v.count != n || v.shift != 15 {
+		t.Fatalf("count %d and shift %d, want %d and 15", v.count, v.shift, n)
+	}
+	w := v
+	for i := 0; i < n; i += 3 {
+		w = w.assoc(i, int_value(-i))
+	}
+	for i := 0; i < n; i++ {
+		want := int64(i)
+		if i%3 == 0 {
+			want = -want
+		}
+		if got := w.nth(i).number.intval; got != want {
+			t.Fatalf("nth %d gave %d, want %d", i, got, want)
+		}
+		if got := v.nth(i).number.intval; got != int64(i) {
+			t.Fatalf("assoc changed item %d of the old version to %d", i, got)
+		}
+	}
+}
+
+func TestPersistentVectorSharing(t *testing.T) {
+	v := empty_pvec
+	for i := 0; i < 5000; i++ {
+		v = v.conj(int_value(i))
+	}
+	w := v.assoc(0, int_value(-1))
+	if v.nth(0).number.intval != 0 || w.nth(0).number.intval != -1 {
+		t.Fatalf("assoc gave %d and %d", v.nth(0).number.intval, w.nth(0).number.intval)
+	}
+	if &v.tail[0] != &w.tail[0] {
+		t.Fatalf("assoc in the trie copied the tail")
+	}
+	for i := 1; i < len(v.root.children); i++ {
+		if v.root.children[i] != w.root.children[i] {
+			t.Fatalf("assoc of item 0 copied the root's child %d", i)
+		}
+	}
+	c := v.conj(int_value(5000))
+	if c.root != v.root || v.count != 5000 {
+		t.Fatalf("conj onto a tail with room copied the trie")
+	}
+}
+
+func TestPersistentCollectionsFromRadu(t *testing.T) {
+	b := new_test_env()
+	run(t, b, `(define m (atom (persistent-map)))
+(dotimes (i 2000) (swap! m (lambda (x) (assoc x i (* i 2)))))
+(define old @m)
+(dotimes (i 1000) (swap! m (lambda (x) (dissoc x (* i 2)))))`)
+	expect(t, b, "(len old)", "2000")
+	expect(t, b, "(len @m)", "1000")
+	expect(t, b, "(get @m 1999)", "3998")
+	expect(t, b, "(get @m 1998 'gone)", "gone")
+	expect(t, b, "(get old 1998)", "3996")
+	expect(t, b, "(contains? @m 1024)", "#f")
+	expect(t, b, "(contains? @m 1025)", "#t")
+	run(t, b, `(define v (atom (persistent-vector)))
+(dotimes (i 1500) (swap! v (lambda (x) (conj x i))))
+(define before @v)
+(swap! v (lambda (x) (update x 1100 (lambda (n) (* n 10)))))`)
+	expect(t, b, "(get @v 1100)", "11000")
+	expect(t, b, "(get before 1100)", "1100")
+	expect(t, b, "(get @v 1499)", "1499")
+	expect(t, b, "(len before)", "1500")
+}
+
+func TestHandlerCaseSignalAndWarn(t *testing.T) {
+	b := new_test_env()
+	expect(t, b, `(handler-case (warn "w") (warning (c) 'w))`, "w")
+	expect(t, b, `(handler-case (signal (make-condition 'error "x")) (warning (c) 'w) (error (c) (error-object-message c)))`, `"x"`)
+	expect(t, b, `(handler-case (progn (signal "unhandled") 'went-on) (error (c) 'e))`, "went-on")
+	expect(t, b, `(handler-case (error "boom" 1) (error (c) (error-object-irritants c)))`, "(1)")
+	expect(t, b, `(handler-case (handler-case (warn "deep") (error (c) 'inner)) (warning (c) 'outer))`, "outer")
+	expect(t, b, `(handler-case (join (spawn (lambda () (error "in a task")))) (error (c) 'joined))`, "joined")
+}
+
+func TestTimers(t *testing.T) {
+	b := new_test_env()
+	run(t, b, `(define fired (atom 0))
+(define kept (after 5 (lambda () (swap! fired (lambda (x) (+ x 1))))))
+(define dropped (after 5 (lambda () (swap! fired (lambda (x) (+ x 100))))))`)
+	expect(t, b, "(cancel-timer dropped)", "#t")
+	expect(t, b, "(cancel-timer dropped)", "#f")
+	run(t, b, "(run-event-loop)")
+	expect(t, b, "@fired", "1")
+	expect(t, b, "(cancel-timer kept)", "#f")
+	/* cancelling an every timer from another task while the event loop
+	re-arms it */
+	run(t, b, `(define ticks (atom 0))
+(define tick (every 0 (lambda () (swap! ticks (lambda (x) (+ x 1))))))
+(define stopper (spawn (lambda () (progn (sleep 5) (cancel-timer tick)))))
+(run-event-loop 50)`)
+	expect(t, b, "(join stopper)", "#t")
+	expect(t, b, "(> @ticks 0)", "#t")
+	run(t, b, "(define seen @ticks) (run-event-loop 20)")
+	expect(t, b, "(eq seen @ticks)", "#t")
+	run(t, b, `(after 0 (lambda () (error "in a callback")))`)
+	expect(t, b, `(handler-case (run-event-loop) (error (c) (error-object-message c)))`, `"in a callback"`)
+}
+
+func TestActors(t *testing.T) {
+	b := new_test_env()
+	run(t, b, `(define echo (lambda () (receive!
+	((list 'ping from) (progn (send! from (list 'pong (self))) (echo)))
+	('stop 'stopped))))
+(define p (spawn-actor echo))
+(send! p (list 'ping (self)))`)
+	expect(t, b, "(receive! ((list 'pong who) (eq who p)))", "#t")
+	run(t, b, "(send! p 'stop)")
+	expect(t, b, "(join p)", "stopped")
+	/* messages no clause wants stay in the mailbox, in order */
+	run(t, b, "(send! (self) 1) (send! (self) 2) (send! (self) 'b)")
+	expect(t, b, `(receive! ('b "b first"))`, `"b first"`)
+	expect(t, b, "(receive! (x #:when (> x 1) x))", "2")
+	expect(t, b, "(receive! (x x))", "1")
+	expect(t, b, "(receive! (x x) (after 10 'timeout))", "timeout")
+	run(t, b, `(define bad (spawn-actor (lambda () (error "worker died" 42))))
+(monitor bad)`)
+	expect(t, b, "(receive! ((list 'down pid reason) (error-object-message reason)))", `"worker died"`)
+	run(t, b, `(define good (spawn-actor (lambda (x) (* x 2)) 21))
+(monitor good)`)
+	expect(t, b, "(receive! ((list 'down pid r) r))", "normal")
+	run(t, b, `(define linked (spawn-actor (lambda () (progn (sleep 10) (error "later" 7)))))
+(link linked)`)
+	expect(t, b, "(receive! ((list 'exit pid e) (error-object-irritants e)) (after 2000 'nothing))", "(7)")
+	for _, bad := range []string{"(receive! 5)", "(receive! (x))", "(receive!)"} {
+		if _, err := run_source(bad, t.Name(), b); err == nil {
+			t.Errorf("%s gave no error", bad)
+		}
+	}
+}
+
+func TestHandlerBindBuiltinErrors(t *testing.T) {
+	b := new_test_env()
+	expect(t, b, `(call/ec (lambda (k) (handler-bind ((error (lambda (c) (k "handled")))) (strcat 1 2))))`, `"handled"`)
+	expect(t, b, `(call/ec (lambda (k) (handler-bind ((error (lambda (c) (k "handled")))) (error "boom"))))`, `"handled"`)
+	/* signalled once, by the innermost handler-bind, reaching the outer
+	handlers too */
+	run(t, b, "(define calls (atom 0))")
+	expect(t, b, `(call/ec (lambda (k) (handler-bind ((error (lambda (c) (k @calls))))
+	(handler-bind ((error (lambda (c) (swap! calls (lambda (n) (+ n 1))))))
+		(handler-bind ((error (lambda (c) (swap! calls (lambda (n) (+ n 1)))))) (strcat 1 2))))))`, "2")
+	expect(t, b, `(restart-case (handler-bind ((error (lambda (c) (invoke-restart 'use 7)))) (strcat 1 2)) (use (v) v))`, "7")
+}
+
+func TestLambdaRestParams(t *testing.T) {
+	b := new_test_env()
+	expect(t, b, "((lambda (a . r) r) 1 2 3)", "(2 -> 3)")
+	expect(t, b, "((lambda (a . r) a) 1 2 3)", "1")
+	expect(t, b, "((lambda (a . r) r) 1)", "()")
+	expect(t, b, "((lambda (_ b) b) 1 2)", "2")
+	expect(t, b, "((lambda ((a . r)) r) (list 1 2 3))", "(2 -> 3)")
+	expect(t, b, "((lambda ((_ b)) b) (list 1 2))", "2")
+	if _, err := run_source("((lambda (a . r) r))", t.Name(), b); err == nil {
+		t.Errorf("a dotted lambda called with too few arguments should fail")
+	}
+}
+
+func TestUnterminatedBarSymbol(t *testing.T) {
+	b := new_test_env()
+	run(t, b, "(define ran 0)")
+	_, err := run_source("(set! ran 1)\n(list |abc 1)", t.Name(), b)
+	re, ok := err.(*radu_error)
+	if !ok || string(re.obj.err().kind) != "parse-error" {
+		t.Fatalf("got %v, want a parse-error", err)
+	}
+	if re.form == nil || re.form.val.pos.line != 2 {
+		t.Errorf("parse-error isn't placed on line 2: %s", describe_error(err))
+	}
+	/* nothing runs from source that didn't parse */
+	expect(t, b, "ran", "0")
+	expect(t, b, "(list '|ab c| 1)", "(|ab c| -> 1)")
+}
+
+func TestLiteralsInsideQuote(t *testing.T) {
+	b := new_test_env()
+	expect(t, b, "'(#(1 2) 3)", "(#(1 2) -> 3)")
+	expect(t, b, "(vector-ref (car '(#(1 2) 3)) 1)", "2")
+	expect(t, b, "'(a #hash((x 1)))", "(a -> #hash((x . 1)))")
+	expect(t, b, "(hash-ref (car (cdr '(a #hash((x 1))))) 'x)", "1")
+	expect(t, b, "#(1 #(2 3) (4 5))", "#(1 #(2 3) (4 -> 5))")
+}